@@ -2,19 +2,29 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"math/rand"
+	"net/url"
 	"os"
+	"path/filepath"
 	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/bbengfort/catena"
 	"github.com/bbengfort/catena/config"
 	"github.com/bbengfort/catena/migrations"
+	"github.com/bbengfort/catena/seed"
+	"github.com/go-sql-driver/mysql"
 	"github.com/joho/godotenv"
 	"github.com/urfave/cli"
 	"gopkg.in/yaml.v2"
 
-	// use postgres for the test database
+	// database drivers for the supported dialects
 	_ "github.com/lib/pq"
+	_ "modernc.org/sqlite"
 )
 
 func main() {
@@ -59,7 +69,7 @@ func main() {
 				},
 				cli.StringFlag{
 					Name:   "D, db",
-					Usage:  "the database uri of the catena postgres database",
+					Usage:  "the database uri of the catena database",
 					EnvVar: "DATABASE_URL",
 				},
 			},
@@ -76,6 +86,57 @@ func main() {
 				},
 			},
 		},
+		{
+			Name:     "graph:import",
+			Usage:    "bulk import nodes and edges from csv, tsv or jsonl files",
+			Action:   importGraph,
+			Category: "graph",
+			Before:   updateConfig,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:   "D, db",
+					Usage:  "the database uri of the catena database",
+					EnvVar: "DATABASE_URL",
+				},
+				cli.StringFlag{
+					Name:  "n, nodes",
+					Usage: "the file of nodes to import, with a column for the node key",
+				},
+				cli.StringFlag{
+					Name:  "e, edges",
+					Usage: "the file of edges to import, with source and target columns of node keys",
+				},
+				cli.StringFlag{
+					Name:  "r, rejects",
+					Usage: "the csv file that rows which cannot be imported are written to",
+					Value: "rejects.csv",
+				},
+				cli.StringFlag{
+					Name:  "node-table",
+					Usage: "the table to import the nodes into (required)",
+				},
+				cli.StringFlag{
+					Name:  "node-key",
+					Usage: "the natural key column of the nodes (required)",
+				},
+				cli.StringFlag{
+					Name:  "node-id",
+					Usage: "the column of the nodes referenced by edges, or empty to reference the key",
+				},
+				cli.StringFlag{
+					Name:  "edge-table",
+					Usage: "the table to import the edges into (required)",
+				},
+				cli.StringFlag{
+					Name:  "edge-source",
+					Usage: "the column of the edges that references the source node (required)",
+				},
+				cli.StringFlag{
+					Name:  "edge-target",
+					Usage: "the column of the edges that references the target node (required)",
+				},
+			},
+		},
 		{
 			Name:      "db:revision",
 			Usage:     "print the current migration status of the database",
@@ -86,7 +147,7 @@ func main() {
 			Flags: []cli.Flag{
 				cli.StringFlag{
 					Name:   "D, db",
-					Usage:  "the database uri of the catena postgres database",
+					Usage:  "the database uri of the catena database",
 					EnvVar: "DATABASE_URL",
 				},
 				cli.Int64Flag{
@@ -98,6 +159,10 @@ func main() {
 					Name:  "n, new",
 					Usage: "create a new revision with the name as args",
 				},
+				cli.BoolFlag{
+					Name:  "t, timestamp",
+					Usage: "use the current timestamp as the revision of the new migration",
+				},
 			},
 		},
 		{
@@ -109,7 +174,7 @@ func main() {
 			Flags: []cli.Flag{
 				cli.StringFlag{
 					Name:   "D, db",
-					Usage:  "the database uri of the catena postgres database",
+					Usage:  "the database uri of the catena database",
 					EnvVar: "DATABASE_URL",
 				},
 				cli.Int64Flag{
@@ -117,6 +182,302 @@ func main() {
 					Usage: "specify a revision to migrate (or rollback) the database to",
 					Value: -1,
 				},
+				cli.BoolFlag{
+					Name:  "p, plan",
+					Usage: "print the migrations that would be executed and exit",
+				},
+				cli.StringFlag{
+					Name:  "o, output",
+					Usage: "specify the plan output format (text or json)",
+					Value: "text",
+				},
+				cli.IntFlag{
+					Name:  "R, retries",
+					Usage: "retry migrations that time out waiting for locks up to this many times",
+				},
+				cli.DurationFlag{
+					Name:  "W, retry-wait",
+					Usage: "the time to wait before the first retry, doubled after each retry",
+					Value: 5 * time.Second,
+				},
+			},
+		},
+		{
+			Name:     "db:baseline",
+			Usage:    "mark the migrations through a revision as applied to an existing database",
+			Action:   baseline,
+			Category: "database",
+			Before:   updateConfig,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:   "D, db",
+					Usage:  "the database uri of the catena database",
+					EnvVar: "DATABASE_URL",
+				},
+				cli.Int64Flag{
+					Name:  "r, revision",
+					Usage: "the last revision that the existing schema matches",
+					Value: -1,
+				},
+			},
+		},
+		{
+			Name:      "db:lint",
+			Usage:     "check the migration files for destructive and locking operations",
+			ArgsUsage: "[dir]",
+			Action:    lint,
+			Category:  "database",
+			Flags: []cli.Flag{
+				cli.StringSliceFlag{
+					Name:   "L, large-table",
+					Usage:  "a large table that must not be locked (may be repeated)",
+					EnvVar: "CATENA_LINT_LARGE_TABLES",
+				},
+				cli.BoolFlag{
+					Name:  "s, strict",
+					Usage: "exit with an error if there are any warnings",
+				},
+			},
+		},
+		{
+			Name:     "db:squash",
+			Usage:    "squash the migrations through a revision into a baseline migration",
+			Action:   squash,
+			Category: "database",
+			Flags: []cli.Flag{
+				cli.Int64Flag{
+					Name:  "t, through",
+					Usage: "the last revision to squash into the baseline",
+					Value: -1,
+				},
+				cli.BoolFlag{
+					Name:  "delete",
+					Usage: "delete the migration files replaced by the baseline",
+				},
+				cli.StringFlag{
+					Name:  "d, dir",
+					Usage: "the directory containing the migration files",
+					Value: "migrations",
+				},
+				cli.StringFlag{
+					Name:  "o, output",
+					Usage: "write the baseline to another directory, keeping the replaced files",
+				},
+			},
+		},
+		{
+			Name:     "db:test",
+			Usage:    "verify that every migration round trips up, down and up against a scratch database",
+			Action:   roundtrip,
+			Category: "database",
+			Before:   updateConfig,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:   "D, db",
+					Usage:  "the database uri of a scratch database",
+					EnvVar: "DATABASE_URL",
+				},
+			},
+		},
+		{
+			Name:     "db:schema",
+			Usage:    "dump the schema produced by the migrations or diff it against a database",
+			Category: "database",
+			Subcommands: []cli.Command{
+				{
+					Name:   "dump",
+					Usage:  "migrate a scratch database and write its normalized schema",
+					Action: dumpSchema,
+					Before: updateConfig,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "D, db",
+							Usage: "the database uri of a scratch database without any migrations applied (required)",
+						},
+						cli.StringFlag{
+							Name:  "o, out",
+							Usage: "the path to write the schema to",
+							Value: "schema.sql",
+						},
+					},
+				},
+				{
+					Name:   "diff",
+					Usage:  "compare the schema of the database with the dumped schema",
+					Action: diffSchema,
+					Before: updateConfig,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:   "D, db",
+							Usage:  "the database uri of the catena database",
+							EnvVar: "DATABASE_URL",
+						},
+						cli.StringFlag{
+							Name:  "i, in",
+							Usage: "the path of the dumped schema",
+							Value: "schema.sql",
+						},
+					},
+				},
+			},
+		},
+		{
+			Name:     "db:seed",
+			Usage:    "load seed data and synthetic graphs into a development database",
+			Action:   seedDB,
+			Category: "database",
+			Before:   updateConfig,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:   "D, db",
+					Usage:  "the database uri of the development database",
+					EnvVar: "DATABASE_URL",
+				},
+				cli.StringFlag{
+					Name:   "e, env",
+					Usage:  "the environment of the seed set to load (dev, test or demo)",
+					Value:  "dev",
+					EnvVar: "CATENA_SEED_ENV",
+				},
+				cli.StringFlag{
+					Name:  "d, dir",
+					Usage: "the directory containing the seed sets",
+					Value: "seeds",
+				},
+				cli.StringFlag{
+					Name:  "g, graph",
+					Usage: "also load a synthetic graph generated by ba (Barabási–Albert) or er (Erdős–Rényi)",
+				},
+				cli.IntFlag{
+					Name:  "n, nodes",
+					Usage: "the number of nodes of the synthetic graph",
+					Value: 1000,
+				},
+				cli.IntFlag{
+					Name:  "m, follows",
+					Usage: "the number of nodes each new node follows in a ba graph",
+					Value: 3,
+				},
+				cli.Float64Flag{
+					Name:  "p, probability",
+					Usage: "the probability of each edge in an er graph",
+					Value: 0.01,
+				},
+				cli.Int64Flag{
+					Name:  "s, seed",
+					Usage: "the random seed, the same seed generates the same graph",
+					Value: 1,
+				},
+				cli.StringFlag{
+					Name:  "node-table",
+					Usage: "the table to load the nodes of the graph into",
+					Value: "users",
+				},
+				cli.StringFlag{
+					Name:  "node-key",
+					Usage: "the natural key column of the nodes, populated with generated names",
+					Value: "username",
+				},
+				cli.StringFlag{
+					Name:  "node-id",
+					Usage: "the column of the nodes referenced by edges, or empty to reference the key",
+					Value: "id",
+				},
+				cli.StringSliceFlag{
+					Name:  "node-column",
+					Usage: "another column of the nodes as column=format, e.g. email=%s@example.com",
+				},
+				cli.StringFlag{
+					Name:  "node-prefix",
+					Usage: "the prefix of the generated names of the nodes",
+					Value: "user",
+				},
+				cli.StringFlag{
+					Name:  "edge-table",
+					Usage: "the table to load the edges of the graph into",
+					Value: "follows",
+				},
+				cli.StringFlag{
+					Name:  "edge-source",
+					Usage: "the column of the edges that references the source node",
+					Value: "follower_id",
+				},
+				cli.StringFlag{
+					Name:  "edge-target",
+					Usage: "the column of the edges that references the target node",
+					Value: "followee_id",
+				},
+			},
+		},
+		{
+			Name:     "db:history",
+			Usage:    "show the log of migrations that were applied or rolled back",
+			Action:   history,
+			Category: "database",
+			Before:   updateConfig,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:   "D, db",
+					Usage:  "the database uri of the catena database",
+					EnvVar: "DATABASE_URL",
+				},
+				cli.IntFlag{
+					Name:  "n, limit",
+					Usage: "the number of most recent entries to show, or 0 for all",
+					Value: 20,
+				},
+				cli.StringFlag{
+					Name:  "o, output",
+					Usage: "the output format of the history, either text or json",
+					Value: "text",
+				},
+			},
+		},
+		{
+			Name:     "db:status",
+			Usage:    "list the migrations and whether they have been applied to the database",
+			Action:   status,
+			Category: "database",
+			Before:   updateConfig,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:   "D, db",
+					Usage:  "the database uri of the catena database",
+					EnvVar: "DATABASE_URL",
+				},
+				cli.StringFlag{
+					Name:  "o, output",
+					Usage: "the output format of the status, either table, json or yaml",
+					Value: "table",
+				},
+			},
+		},
+		{
+			Name:     "db:verify",
+			Usage:    "verify that applied migrations have not been modified since they were run",
+			Action:   verify,
+			Category: "database",
+			Before:   updateConfig,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:   "D, db",
+					Usage:  "the database uri of the catena database",
+					EnvVar: "DATABASE_URL",
+				},
+			},
+		},
+		{
+			Name:     "db:unlock",
+			Usage:    "release a sqlite migrations lock left behind by a process that exited while migrating",
+			Action:   unlock,
+			Category: "database",
+			Before:   updateConfig,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:   "D, db",
+					Usage:  "the database uri of the catena database",
+					EnvVar: "DATABASE_URL",
+				},
 			},
 		},
 	}
@@ -152,9 +513,22 @@ func makeConfig(c *cli.Context) (err error) {
 		}
 	}
 
+	configureMigrations()
 	return nil
 }
 
+// Configure the default migrator from the loaded configuration
+func configureMigrations() {
+	migrations.SetOptions(migrations.Options{
+		LockWait:           conf.Migrations.LockWait,
+		LockTimeout:        conf.Migrations.LockTimeout,
+		StatementTimeout:   conf.Migrations.StatementTimeout,
+		OutOfOrder:         conf.Migrations.OutOfOrder,
+		TimestampRevisions: conf.Migrations.Timestamps,
+		Version:            catena.Version,
+	})
+}
+
 func updateConfig(c *cli.Context) (err error) {
 	// Update the config from the context manually for CLI flags
 	// TODO: should we do this with reflection as well?
@@ -177,6 +551,46 @@ func updateConfig(c *cli.Context) (err error) {
 	return nil
 }
 
+// Open the database specified by the database url, selecting the driver and migrations
+// dialect from the scheme of the url, e.g. postgres://, sqlite://path or mysql://.
+func connect() (db *sql.DB, err error) {
+	if conf.DBURL == "" {
+		return nil, errors.New("could not connect: no database url specified")
+	}
+
+	var u *url.URL
+	if u, err = url.Parse(conf.DBURL); err != nil {
+		return nil, fmt.Errorf("could not parse database url: %s", err)
+	}
+
+	var dialect migrations.Dialect
+	if dialect, err = migrations.DialectFor(u.Scheme); err != nil {
+		return nil, err
+	}
+
+	driver, dsn := "postgres", conf.DBURL
+	switch dialect {
+	case migrations.SQLite:
+		driver, dsn = "sqlite", strings.TrimPrefix(strings.TrimPrefix(conf.DBURL, u.Scheme+":"), "//")
+	case migrations.MySQL:
+		dbconf := mysql.NewConfig()
+		dbconf.Net = "tcp"
+		dbconf.Addr = u.Host
+		dbconf.User = u.User.Username()
+		dbconf.Passwd, _ = u.User.Password()
+		dbconf.DBName = strings.TrimPrefix(u.Path, "/")
+		dbconf.ParseTime = true
+		driver, dsn = "mysql", dbconf.FormatDSN()
+	}
+
+	if db, err = sql.Open(driver, dsn); err != nil {
+		return nil, fmt.Errorf("could not connect to database: %s", err)
+	}
+
+	migrations.SetDialect(dialect)
+	return db, nil
+}
+
 //===========================================================================
 // Server Commands
 //===========================================================================
@@ -226,29 +640,81 @@ func configure(c *cli.Context) (err error) {
 	return nil
 }
 
+//===========================================================================
+// Graph Commands
+//===========================================================================
+
+// The tables of the graph must be specified since no migration defines them. The
+// rejects file is removed if every row was imported.
+func importGraph(c *cli.Context) (err error) {
+	if c.String("nodes") == "" && c.String("edges") == "" {
+		return cli.NewExitError("specify the nodes or edges file to import", 1)
+	}
+
+	tables := seed.GraphTables{
+		Nodes:  c.String("node-table"),
+		Key:    c.String("node-key"),
+		ID:     c.String("node-id"),
+		Edges:  c.String("edge-table"),
+		Source: c.String("edge-source"),
+		Target: c.String("edge-target"),
+	}
+
+	if tables.Nodes == "" || tables.Key == "" || tables.Edges == "" || tables.Source == "" || tables.Target == "" {
+		return cli.NewExitError("specify the --node-table, --node-key, --edge-table, --edge-source and --edge-target of the graph", 1)
+	}
+
+	var db *sql.DB
+	if db, err = connect(); err != nil {
+		return cli.NewExitError(err, 1)
+	}
+
+	var rejects *os.File
+	if rejects, err = os.Create(c.String("rejects")); err != nil {
+		return cli.NewExitError(err, 1)
+	}
+	defer rejects.Close()
+
+	var nodes, edges, rejected int
+	if nodes, edges, rejected, err = seed.ImportGraph(db, migrations.CurrentDialect(), tables, c.String("nodes"), c.String("edges"), rejects); err != nil {
+		return cli.NewExitError(err, 1)
+	}
+
+	fmt.Printf("imported graph (%d nodes and %d edges inserted)\n", nodes, edges)
+	if rejected == 0 {
+		rejects.Close()
+		os.Remove(rejects.Name())
+		return nil
+	}
+
+	fmt.Printf("%d rows could not be imported, see %s\n", rejected, rejects.Name())
+	return nil
+}
+
 //===========================================================================
 // Database Commands
 //===========================================================================
 
 func revision(c *cli.Context) (err error) {
 	if c.Bool("new") {
+		if c.Bool("timestamp") {
+			conf.Migrations.Timestamps = true
+			configureMigrations()
+		}
+
 		var path string
 		if path, err = migrations.New(strings.Join(c.Args(), "_"), "migrations"); err != nil {
 			return cli.NewExitError(err, 1)
 		}
 
 		fmt.Printf("blank migration created at %s\n", path)
-		fmt.Println("remember to run go generate ./... to add the migration")
+		fmt.Println("rebuild catena to embed the migration")
 		return
 	}
 
-	if conf.DBURL == "" {
-		return cli.NewExitError("could not connect: no database url specified", 1)
-	}
-
 	var db *sql.DB
-	if db, err = sql.Open("postgres", conf.DBURL); err != nil {
-		return cli.NewExitError(fmt.Errorf("could not connect to database: %s", err), 1)
+	if db, err = connect(); err != nil {
+		return cli.NewExitError(err, 1)
 	}
 
 	var m migrations.Migration
@@ -269,17 +735,39 @@ func revision(c *cli.Context) (err error) {
 }
 
 func migrate(c *cli.Context) (err error) {
-	if conf.DBURL == "" {
-		return cli.NewExitError("could not connect: no database url specified", 1)
+	var db *sql.DB
+	if db, err = connect(); err != nil {
+		return cli.NewExitError(err, 1)
 	}
 
-	var db *sql.DB
-	if db, err = sql.Open("postgres", conf.DBURL); err != nil {
-		return cli.NewExitError(fmt.Errorf("could not connect to database: %s", err), 1)
+	if c.Bool("plan") {
+		return plan(c, db)
 	}
 
+	// Migrations that time out were not applied so they can be retried, e.g. once the
+	// traffic holding the locks they are waiting for has drained.
 	var n int
-	if n, err = migrations.Migrate(c.Int64("revision"), db); err != nil {
+	wait := c.Duration("retry-wait")
+	for attempt := 0; ; attempt++ {
+		var applied int
+		applied, err = migrations.Migrate(c.Int64("revision"), db)
+		n += applied
+
+		var timeout *migrations.TimeoutError
+		if err == nil || !errors.As(err, &timeout) || attempt >= c.Int("retries") {
+			break
+		}
+
+		fmt.Printf("%s\nretrying in %s (retry %d of %d)\n", err, wait, attempt+1, c.Int("retries"))
+		time.Sleep(wait)
+		wait *= 2
+	}
+
+	if err != nil {
+		var timeout *migrations.TimeoutError
+		if errors.As(err, &timeout) {
+			return cli.NewExitError(fmt.Sprintf("%s\n%d migrations affected before the timeout; increase the timeouts of the migration or retry with --retries", err, n), 1)
+		}
 		return cli.NewExitError(err, 1)
 	}
 	fmt.Printf("%d migrations affected\n", n)
@@ -292,3 +780,546 @@ func migrate(c *cli.Context) (err error) {
 	fmt.Printf("\ncurrent migration:\n%s\n", m.String())
 	return nil
 }
+
+func plan(c *cli.Context, db *sql.DB) (err error) {
+	if output := c.String("output"); output != "text" && output != "json" {
+		return cli.NewExitError(fmt.Errorf("unknown output format %q", output), 1)
+	}
+
+	var steps []migrations.Step
+	if steps, err = migrations.Plan(c.Int64("revision"), db); err != nil {
+		return cli.NewExitError(err, 1)
+	}
+
+	switch c.String("output") {
+	case "text":
+		if len(steps) == 0 {
+			fmt.Println("database is up to date, no migrations would be executed")
+			return nil
+		}
+
+		for i, step := range steps {
+			if step.Repeatable() {
+				fmt.Printf("-- %d. %s repeatable %q (%s)\n", i+1, step.Direction, step.Name, step.Filename())
+			} else {
+				fmt.Printf("-- %d. %s revision %d %q (%s)\n", i+1, step.Direction, step.Revision, step.Name, step.Filename())
+			}
+			if step.IsGo() {
+				fmt.Printf("-- executes the go %s function registered in %s\n", step.Direction, step.Filename())
+				fmt.Println()
+				continue
+			}
+			if !step.Transactional() {
+				fmt.Println("-- executed outside of a transaction")
+			}
+			fmt.Println(step.SQL())
+			fmt.Println()
+		}
+	case "json":
+		type jsonStep struct {
+			Revision  int64  `json:"revision"`
+			Name      string `json:"name"`
+			Filename  string `json:"filename"`
+			Direction string `json:"direction"`
+			Type      string `json:"type"`
+			NoTx      bool   `json:"no_transaction"`
+			SQL       string `json:"sql"`
+		}
+
+		out := make([]jsonStep, 0, len(steps))
+		for _, step := range steps {
+			out = append(out, jsonStep{
+				Revision:  step.Revision,
+				Name:      step.Name,
+				Filename:  step.Filename(),
+				Direction: step.Direction.String(),
+				Type:      stepType(step),
+				NoTx:      !step.Transactional(),
+				SQL:       step.SQL(),
+			})
+		}
+
+		var data []byte
+		if data, err = json.MarshalIndent(out, "", "  "); err != nil {
+			return cli.NewExitError(err, 1)
+		}
+		fmt.Println(string(data))
+	}
+
+	return nil
+}
+
+func history(c *cli.Context) (err error) {
+	if output := c.String("output"); output != "text" && output != "json" {
+		return cli.NewExitError(fmt.Errorf("unknown output format %q", output), 1)
+	}
+
+	var db *sql.DB
+	if db, err = connect(); err != nil {
+		return cli.NewExitError(err, 1)
+	}
+
+	var records []migrations.Record
+	if records, err = migrations.History(db, c.Int("limit")); err != nil {
+		return cli.NewExitError(err, 1)
+	}
+
+	switch c.String("output") {
+	case "text":
+		if len(records) == 0 {
+			fmt.Println("no migrations have been run")
+			return nil
+		}
+
+		for _, rec := range records {
+			outcome := "ok"
+			if !rec.Success {
+				outcome = "FAILED"
+			}
+
+			migration := fmt.Sprintf("revision %d", rec.Revision)
+			if rec.Repeatable {
+				migration = "repeatable"
+			}
+
+			fmt.Printf("%s  %-4s %s %q  %s in %s by %s@%s (catena %s)\n", rec.Started.Local().Format("2006-01-02 15:04:05"), rec.Direction, migration, rec.Name, outcome, rec.Duration, rec.User, rec.Host, rec.Version)
+			if rec.Error != "" {
+				fmt.Printf("    %s\n", rec.Error)
+			}
+		}
+	case "json":
+		type jsonRecord struct {
+			ID         int64     `json:"id"`
+			Revision   *int64    `json:"revision"`
+			Name       string    `json:"name"`
+			Direction  string    `json:"direction"`
+			Started    time.Time `json:"started"`
+			DurationMS int64     `json:"duration_ms"`
+			Version    string    `json:"version"`
+			Host       string    `json:"host"`
+			User       string    `json:"user"`
+			Success    bool      `json:"success"`
+			Error      string    `json:"error,omitempty"`
+		}
+
+		out := make([]jsonRecord, 0, len(records))
+		for _, rec := range records {
+			record := jsonRecord{
+				ID:         rec.ID,
+				Name:       rec.Name,
+				Direction:  rec.Direction.String(),
+				Started:    rec.Started,
+				DurationMS: rec.Duration.Milliseconds(),
+				Version:    rec.Version,
+				Host:       rec.Host,
+				User:       rec.User,
+				Success:    rec.Success,
+				Error:      rec.Error,
+			}
+
+			if !rec.Repeatable {
+				revision := rec.Revision
+				record.Revision = &revision
+			}
+			out = append(out, record)
+		}
+
+		var data []byte
+		if data, err = json.MarshalIndent(out, "", "  "); err != nil {
+			return cli.NewExitError(err, 1)
+		}
+		fmt.Println(string(data))
+	}
+
+	return nil
+}
+
+func baseline(c *cli.Context) (err error) {
+	if c.Int64("revision") < 0 {
+		return cli.NewExitError("specify the revision to baseline the database at", 1)
+	}
+
+	var db *sql.DB
+	if db, err = connect(); err != nil {
+		return cli.NewExitError(err, 1)
+	}
+
+	var n int
+	if n, err = migrations.Baseline(c.Int64("revision"), db); err != nil {
+		return cli.NewExitError(err, 1)
+	}
+
+	fmt.Printf("%d migrations marked as applied without being executed\n", n)
+	return nil
+}
+
+// Seed files are optional when loading a synthetic graph.
+func seedDB(c *cli.Context) (err error) {
+	env := c.String("env")
+	if err = seed.CheckEnvironment(env); err != nil {
+		return cli.NewExitError(err, 1)
+	}
+
+	var db *sql.DB
+	if db, err = connect(); err != nil {
+		return cli.NewExitError(err, 1)
+	}
+
+	dir := c.String("dir")
+	if _, err = os.Stat(dir); err == nil || c.String("graph") == "" {
+		var n int
+		if n, err = seed.Load(db, migrations.CurrentDialect(), dir, env); err != nil {
+			return cli.NewExitError(err, 1)
+		}
+		fmt.Printf("loaded %d seed file(s) from %s for the %s environment\n", n, dir, env)
+	}
+
+	if c.String("graph") == "" {
+		return nil
+	}
+
+	n := c.Int("nodes")
+	rng := rand.New(rand.NewSource(c.Int64("seed")))
+
+	var edges []seed.Edge
+	switch strings.ToLower(c.String("graph")) {
+	case "ba", "barabasi-albert":
+		edges = seed.BarabasiAlbert(n, c.Int("follows"), rng)
+	case "er", "erdos-renyi":
+		edges = seed.ErdosRenyi(n, c.Float64("probability"), rng)
+	default:
+		return cli.NewExitError(fmt.Sprintf("unknown graph generator %q, use ba or er", c.String("graph")), 1)
+	}
+
+	tables := seed.GraphTables{
+		Nodes:   c.String("node-table"),
+		Key:     c.String("node-key"),
+		ID:      c.String("node-id"),
+		Columns: make(map[string]string),
+		Prefix:  c.String("node-prefix"),
+		Edges:   c.String("edge-table"),
+		Source:  c.String("edge-source"),
+		Target:  c.String("edge-target"),
+	}
+
+	for _, column := range c.StringSlice("node-column") {
+		parts := strings.SplitN(column, "=", 2)
+		if len(parts) != 2 {
+			return cli.NewExitError(fmt.Sprintf("could not parse node column %q, specify as column=format", column), 1)
+		}
+		tables.Columns[parts[0]] = parts[1]
+	}
+
+	var nodes, inserted int
+	if nodes, inserted, err = seed.LoadGraph(db, migrations.CurrentDialect(), tables, n, edges); err != nil {
+		return cli.NewExitError(err, 1)
+	}
+
+	fmt.Printf("loaded graph of %d nodes and %d edges (%d nodes and %d edges inserted)\n", n, len(edges), nodes, inserted)
+	return nil
+}
+
+// Exits with status 1 if there are lint errors (or warnings in strict mode) and with
+// status 2 if the migration files cannot be parsed, so that it can be used in CI.
+func lint(c *cli.Context) (err error) {
+	dir := "migrations"
+	if c.NArg() > 0 {
+		dir = c.Args().First()
+	}
+
+	var names []string
+	if names, err = filepath.Glob(filepath.Join(dir, "*.sql")); err != nil {
+		return cli.NewExitError(fmt.Errorf("could not list migrations: %s", err), 2)
+	}
+
+	var nerrors, nwarnings int
+	for _, name := range names {
+		var m *migrations.Migration
+		if m, err = migrations.Parse(name); err != nil {
+			return cli.NewExitError(err, 2)
+		}
+
+		for _, issue := range migrations.Lint(m, c.StringSlice("large-table")...) {
+			fmt.Println(issue)
+			if issue.Severity == migrations.Error {
+				nerrors++
+			} else {
+				nwarnings++
+			}
+		}
+	}
+
+	summary := fmt.Sprintf("linted %d migrations: %d errors, %d warnings", len(names), nerrors, nwarnings)
+	if nerrors > 0 || (c.Bool("strict") && nwarnings > 0) {
+		return cli.NewExitError(summary, 1)
+	}
+
+	fmt.Println(summary)
+	return nil
+}
+
+func squash(c *cli.Context) (err error) {
+	if c.Int64("through") < 0 {
+		return cli.NewExitError("specify the revision to squash through", 1)
+	}
+
+	if !c.Bool("delete") && c.String("output") == "" {
+		return cli.NewExitError("specify --delete to replace the squashed migrations with the baseline or --output to write it to another directory", 1)
+	}
+
+	var (
+		path     string
+		replaced []string
+	)
+	if path, replaced, err = migrations.Squash(c.Int64("through"), c.String("dir"), c.String("output"), c.Bool("delete")); err != nil {
+		return cli.NewExitError(err, 1)
+	}
+
+	fmt.Printf("squashed %d migrations into %s\n", len(replaced), path)
+	if !c.Bool("delete") {
+		fmt.Printf("move the baseline into %s once the replaced migrations are removed:\n", c.String("dir"))
+		for _, filename := range replaced {
+			fmt.Printf("  %s\n", filename)
+		}
+		return nil
+	}
+
+	fmt.Println("rebuild catena to embed the baseline")
+	return nil
+}
+
+func roundtrip(c *cli.Context) (err error) {
+	var db *sql.DB
+	if db, err = connect(); err != nil {
+		return cli.NewExitError(err, 1)
+	}
+
+	var n int
+	if n, err = migrations.RoundTrip(db); err != nil {
+		return cli.NewExitError(fmt.Errorf("%d migrations verified before failure: %s", n, err), 1)
+	}
+
+	fmt.Printf("%d migrations verified\n", n)
+	return nil
+}
+
+func status(c *cli.Context) (err error) {
+	output := c.String("output")
+	if output != "table" && output != "json" && output != "yaml" {
+		return cli.NewExitError(fmt.Errorf("unknown output format %q", output), 1)
+	}
+
+	var db *sql.DB
+	if db, err = connect(); err != nil {
+		return cli.NewExitError(err, 1)
+	}
+
+	var statuses []migrations.MigrationStatus
+	if statuses, err = migrations.Status(db); err != nil {
+		return cli.NewExitError(err, 1)
+	}
+
+	if output == "table" {
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "REVISION\tNAME\tSTATE\tAPPLIED\tDURATION")
+		for _, s := range statuses {
+			revision, applied, duration := fmt.Sprintf("%d", s.Revision), "-", "-"
+			if s.Repeatable {
+				revision = "R"
+			}
+			if !s.Applied.IsZero() {
+				applied = s.Applied.Local().Format("2006-01-02 15:04:05")
+			}
+			if s.Duration > 0 {
+				duration = s.Duration.String()
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", revision, s.Name, s.State, applied, duration)
+		}
+		return w.Flush()
+	}
+
+	type statusRecord struct {
+		Revision   *int64           `json:"revision" yaml:"revision"`
+		Name       string           `json:"name" yaml:"name"`
+		Repeatable bool             `json:"repeatable" yaml:"repeatable"`
+		State      migrations.State `json:"state" yaml:"state"`
+		Applied    *time.Time       `json:"applied" yaml:"applied"`
+		DurationMS *int64           `json:"duration_ms" yaml:"duration_ms"`
+	}
+
+	out := make([]statusRecord, 0, len(statuses))
+	for _, s := range statuses {
+		record := statusRecord{Name: s.Name, Repeatable: s.Repeatable, State: s.State}
+		if !s.Repeatable {
+			revision := s.Revision
+			record.Revision = &revision
+		}
+		if !s.Applied.IsZero() {
+			applied := s.Applied
+			record.Applied = &applied
+		}
+		if s.Duration > 0 {
+			duration := s.Duration.Milliseconds()
+			record.DurationMS = &duration
+		}
+		out = append(out, record)
+	}
+
+	var data []byte
+	if output == "json" {
+		data, err = json.MarshalIndent(out, "", "  ")
+	} else {
+		data, err = yaml.Marshal(out)
+	}
+
+	if err != nil {
+		return cli.NewExitError(err, 1)
+	}
+	fmt.Println(strings.TrimSpace(string(data)))
+	return nil
+}
+
+func verify(c *cli.Context) (err error) {
+	var db *sql.DB
+	if db, err = connect(); err != nil {
+		return cli.NewExitError(err, 1)
+	}
+
+	var modified []migrations.Migration
+	if modified, err = migrations.Verify(db); err != nil {
+		return cli.NewExitError(err, 1)
+	}
+
+	if len(modified) == 0 {
+		fmt.Println("all applied migrations match their checksums")
+		return nil
+	}
+
+	for _, m := range modified {
+		fmt.Printf("revision %d %q (%s) has been modified since it was applied\n", m.Revision, m.Name, m.Filename())
+	}
+	return cli.NewExitError(fmt.Sprintf("detected drift in %d applied migration(s)", len(modified)), 1)
+}
+
+// The lock must only be released once the process that holds it has exited, so the
+// holder is logged before it is released.
+func unlock(c *cli.Context) (err error) {
+	var db *sql.DB
+	if db, err = connect(); err != nil {
+		return cli.NewExitError(err, 1)
+	}
+
+	var released bool
+	if released, err = migrations.Unlock(db); err != nil {
+		return cli.NewExitError(err, 1)
+	}
+
+	if !released {
+		fmt.Println("the migrations lock is not held")
+		return nil
+	}
+	fmt.Println("released the migrations lock")
+	return nil
+}
+
+// The database is migrated, so it must be given explicitly rather than taken from the
+// environment and must not have any migrations applied, so that a shared database is
+// never migrated by accident.
+func dumpSchema(c *cli.Context) (err error) {
+	if c.String("db") == "" {
+		return cli.NewExitError("specify the --db of a scratch database to migrate and dump", 1)
+	}
+
+	var db *sql.DB
+	if db, err = connect(); err != nil {
+		return cli.NewExitError(err, 1)
+	}
+
+	var statuses []migrations.MigrationStatus
+	if statuses, err = migrations.Status(db); err != nil {
+		return cli.NewExitError(err, 1)
+	}
+
+	for _, status := range statuses {
+		if status.State != migrations.Pending {
+			applied := fmt.Sprintf("revision %d", status.Revision)
+			if status.Repeatable {
+				applied = status.Name
+			}
+			return cli.NewExitError(fmt.Sprintf("db:schema dump requires a scratch database but %s has been applied", applied), 1)
+		}
+	}
+
+	if _, err = migrations.Migrate(-1, db); err != nil {
+		return cli.NewExitError(err, 1)
+	}
+
+	var current migrations.Migration
+	if current, err = migrations.Current(db); err != nil {
+		return cli.NewExitError(err, 1)
+	}
+
+	var schema *migrations.Schema
+	if schema, err = migrations.Inspect(db); err != nil {
+		return cli.NewExitError(err, 1)
+	}
+
+	var f *os.File
+	if f, err = os.Create(c.String("out")); err != nil {
+		return cli.NewExitError(err, 1)
+	}
+	defer f.Close()
+
+	if err = schema.Dump(f); err != nil {
+		return cli.NewExitError(err, 1)
+	}
+
+	fmt.Printf("wrote schema of %d table(s) at revision %d to %s\n", len(schema.Tables), current.Revision, c.String("out"))
+	return nil
+}
+
+func diffSchema(c *cli.Context) (err error) {
+	var f *os.File
+	if f, err = os.Open(c.String("in")); err != nil {
+		return cli.NewExitError(err, 1)
+	}
+	defer f.Close()
+
+	var expected *migrations.Schema
+	if expected, err = migrations.ParseSchema(f); err != nil {
+		return cli.NewExitError(err, 1)
+	}
+
+	var db *sql.DB
+	if db, err = connect(); err != nil {
+		return cli.NewExitError(err, 1)
+	}
+
+	var actual *migrations.Schema
+	if actual, err = migrations.Inspect(db); err != nil {
+		return cli.NewExitError(err, 1)
+	}
+
+	diffs := expected.Diff(actual)
+	if len(diffs) == 0 {
+		fmt.Printf("the database matches %s\n", c.String("in"))
+		return nil
+	}
+
+	for _, diff := range diffs {
+		fmt.Println(diff)
+	}
+	return cli.NewExitError(fmt.Sprintf("the database differs from %s in %d place(s)", c.String("in"), len(diffs)), 1)
+}
+
+// Returns the type of migration a step executes for machine readable output.
+func stepType(step migrations.Step) string {
+	switch {
+	case step.IsGo():
+		return "go"
+	case step.Repeatable():
+		return "repeatable"
+	default:
+		return "sql"
+	}
+}
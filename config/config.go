@@ -47,6 +47,13 @@ type Config struct {
 	ReadTimeout  time.Duration `default:"10s" env:"CATENA_READ_TIMEOUT"`
 	WriteTimeout time.Duration `default:"20s" env:"CATENA_WRITE_TIMEOUT"`
 	IdleTimeout  time.Duration `default:"5m" env:"CATENA_IDLE_TIMEOUT"`
+	Migrations   struct {
+		LockWait         time.Duration `default:"1m" env:"CATENA_MIGRATIONS_LOCK_WAIT"`
+		LockTimeout      time.Duration `env:"CATENA_MIGRATIONS_LOCK_TIMEOUT"`
+		StatementTimeout time.Duration `env:"CATENA_MIGRATIONS_STATEMENT_TIMEOUT"`
+		OutOfOrder       bool          `env:"CATENA_MIGRATIONS_OUT_OF_ORDER"`
+		Timestamps       bool          `env:"CATENA_MIGRATIONS_TIMESTAMPS"`
+	}
 }
 
 // Endpoint returns the human readable endpoint using either the domain or the bind addr
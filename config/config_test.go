@@ -29,6 +29,13 @@ func TestConfigDefaults(t *testing.T) {
 	require.Equal(t, 10*time.Second, c.ReadTimeout)
 	require.Equal(t, 20*time.Second, c.WriteTimeout)
 	require.Equal(t, 5*time.Minute, c.IdleTimeout)
+
+	// Migrations Defaults
+	require.Equal(t, 1*time.Minute, c.Migrations.LockWait)
+	require.Zero(t, c.Migrations.LockTimeout)
+	require.Zero(t, c.Migrations.StatementTimeout)
+	require.False(t, c.Migrations.OutOfOrder)
+	require.False(t, c.Migrations.Timestamps)
 }
 
 func TestConfigEnviron(t *testing.T) {
@@ -42,6 +49,12 @@ func TestConfigEnviron(t *testing.T) {
 		"CATENA_READ_TIMEOUT":  "1m",
 		"CATENA_WRITE_TIMEOUT": "500ms",
 		"CATENA_IDLE_TIMEOUT":  "3h",
+
+		"CATENA_MIGRATIONS_LOCK_WAIT":         "30s",
+		"CATENA_MIGRATIONS_LOCK_TIMEOUT":      "5s",
+		"CATENA_MIGRATIONS_STATEMENT_TIMEOUT": "10m",
+		"CATENA_MIGRATIONS_OUT_OF_ORDER":      "true",
+		"CATENA_MIGRATIONS_TIMESTAMPS":        "true",
 	}
 
 	for key, val := range envvars {
@@ -74,4 +87,11 @@ func TestConfigEnviron(t *testing.T) {
 	require.Equal(t, 1*time.Minute, c.ReadTimeout)
 	require.Equal(t, 500*time.Millisecond, c.WriteTimeout)
 	require.Equal(t, 180*time.Minute, c.IdleTimeout)
+
+	// Migrations Defaults
+	require.Equal(t, 30*time.Second, c.Migrations.LockWait)
+	require.Equal(t, 5*time.Second, c.Migrations.LockTimeout)
+	require.Equal(t, 10*time.Minute, c.Migrations.StatementTimeout)
+	require.True(t, c.Migrations.OutOfOrder)
+	require.True(t, c.Migrations.Timestamps)
 }
@@ -1,8 +1,9 @@
 module github.com/bbengfort/catena
 
-go 1.14
+go 1.16
 
 require (
+	github.com/go-sql-driver/mysql v1.6.0
 	github.com/joho/godotenv v1.3.0
 	github.com/julienschmidt/httprouter v1.3.0
 	github.com/lib/pq v1.6.0
@@ -10,4 +11,5 @@ require (
 	github.com/stretchr/testify v1.6.0
 	github.com/urfave/cli v1.22.4
 	gopkg.in/yaml.v2 v2.3.0
+	modernc.org/sqlite v1.14.8
 )
@@ -1,26 +1,167 @@
 -- NOTE: this schema file is always run for any migration command because the migration
 -- commands require this table. This is not true for other migrations, which are only
--- run on demand and whose state are stored in this table.
+-- run on demand and whose state are stored in this table. The generic sections are
+-- PostgreSQL; SQLite and MySQL have their own sections since the schema is not portable.
 -- migrate: up
 
 CREATE TABLE IF NOT EXISTS migrations (
-    "revision" integer NOT NULL,
+    "revision" bigint NOT NULL,
     "name" varchar(128) NOT NULL,
     "active" boolean NOT NULL DEFAULT false,
     "applied" TIMESTAMP WITH TIME ZONE,
     "created" TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    "checksum" varchar(64),
+    "progress" integer,
     PRIMARY KEY ("revision")
 ) WITHOUT OIDS;
 
+-- Upgrade migrations tables that were created before these columns were added.
+ALTER TABLE migrations ADD COLUMN IF NOT EXISTS "checksum" varchar(64);
+ALTER TABLE migrations ADD COLUMN IF NOT EXISTS "progress" integer;
+
+-- Upgrade migrations tables that were created before timestamp revisions were supported.
+DO $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = 'migrations' AND column_name = 'revision' AND data_type = 'integer') THEN
+        ALTER TABLE migrations ALTER COLUMN "revision" TYPE bigint;
+    END IF;
+END $$;
+
 COMMENT ON TABLE "migrations" IS 'Manages the state of database by enabling migrations and rollbacks';
-COMMENT ON COLUMN "migrations"."revision" IS 'The revision id parsed from the filename of the migration';
+COMMENT ON COLUMN "migrations"."revision" IS 'The revision id parsed from the filename of the migration, sequential or a YYYYMMDDHHMMSS timestamp';
 COMMENT ON COLUMN "migrations"."name" IS 'The name of the migration parsed from the filename of the migration';
 COMMENT ON COLUMN "migrations"."active" IS 'If the migration has been applied, set to false on rollbacks or if not applied';
 COMMENT ON COLUMN "migrations"."applied" IS 'Timestamp when the migration was applied, null if rolledback or not applied';
 COMMENT ON COLUMN "migrations"."created" IS 'Timestamp when the migration was created';
+COMMENT ON COLUMN "migrations"."checksum" IS 'SHA-256 hash of the up and down sql when the migration was applied, null if not applied';
+COMMENT ON COLUMN "migrations"."progress" IS 'Number of statements completed by a failed non-transactional migration, null otherwise';
+
+CREATE TABLE IF NOT EXISTS repeatable_migrations (
+    "name" varchar(128) NOT NULL,
+    "filename" varchar(255) NOT NULL,
+    "checksum" varchar(64) NOT NULL,
+    "applied" TIMESTAMP WITH TIME ZONE NOT NULL,
+    PRIMARY KEY ("name")
+) WITHOUT OIDS;
+
+COMMENT ON TABLE "repeatable_migrations" IS 'Manages the state of repeatable migrations, which are re-applied when their sql changes';
+COMMENT ON COLUMN "repeatable_migrations"."name" IS 'The name of the repeatable migration parsed from its R__name.sql filename';
+COMMENT ON COLUMN "repeatable_migrations"."filename" IS 'The filename of the repeatable migration when it was last applied';
+COMMENT ON COLUMN "repeatable_migrations"."checksum" IS 'SHA-256 hash of the sql of the repeatable migration when it was last applied';
+COMMENT ON COLUMN "repeatable_migrations"."applied" IS 'Timestamp when the repeatable migration was last applied';
+
+CREATE TABLE IF NOT EXISTS migration_history (
+    "id" bigserial NOT NULL,
+    "revision" bigint,
+    "name" varchar(128) NOT NULL,
+    "direction" varchar(4) NOT NULL,
+    "started" TIMESTAMP WITH TIME ZONE NOT NULL,
+    "duration_ms" bigint NOT NULL,
+    "version" varchar(32) NOT NULL,
+    "host" varchar(255) NOT NULL,
+    "os_user" varchar(255) NOT NULL,
+    "success" boolean NOT NULL,
+    "error" text,
+    PRIMARY KEY ("id")
+) WITHOUT OIDS;
+
+COMMENT ON TABLE "migration_history" IS 'Append-only log of every migration that was applied or rolled back, including failures';
+COMMENT ON COLUMN "migration_history"."id" IS 'Sequential id of the entry in the log';
+COMMENT ON COLUMN "migration_history"."revision" IS 'The revision of the migration, null for repeatable migrations';
+COMMENT ON COLUMN "migration_history"."name" IS 'The name of the migration';
+COMMENT ON COLUMN "migration_history"."direction" IS 'Either up if the migration was applied or down if it was rolled back';
+COMMENT ON COLUMN "migration_history"."started" IS 'Timestamp when the migration started';
+COMMENT ON COLUMN "migration_history"."duration_ms" IS 'Number of milliseconds the migration took to succeed or fail';
+COMMENT ON COLUMN "migration_history"."version" IS 'The version of catena that ran the migration';
+COMMENT ON COLUMN "migration_history"."host" IS 'The hostname of the machine that ran the migration';
+COMMENT ON COLUMN "migration_history"."os_user" IS 'The operating system user that ran the migration';
+COMMENT ON COLUMN "migration_history"."success" IS 'If the migration succeeded';
+COMMENT ON COLUMN "migration_history"."error" IS 'The error that caused the migration to fail, null if it succeeded';
+
+-- migrate: up sqlite
+
+CREATE TABLE IF NOT EXISTS migrations (
+    "revision" integer NOT NULL,
+    "name" varchar(128) NOT NULL,
+    "active" boolean NOT NULL DEFAULT false,
+    "applied" timestamp,
+    "created" timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    "checksum" varchar(64),
+    "progress" integer,
+    PRIMARY KEY ("revision")
+);
+
+CREATE TABLE IF NOT EXISTS repeatable_migrations (
+    "name" varchar(128) NOT NULL,
+    "filename" varchar(255) NOT NULL,
+    "checksum" varchar(64) NOT NULL,
+    "applied" timestamp NOT NULL,
+    PRIMARY KEY ("name")
+);
+
+CREATE TABLE IF NOT EXISTS migration_history (
+    "id" integer PRIMARY KEY AUTOINCREMENT,
+    "revision" bigint,
+    "name" varchar(128) NOT NULL,
+    "direction" varchar(4) NOT NULL,
+    "started" timestamp NOT NULL,
+    "duration_ms" bigint NOT NULL,
+    "version" varchar(32) NOT NULL,
+    "host" varchar(255) NOT NULL,
+    "os_user" varchar(255) NOT NULL,
+    "success" boolean NOT NULL,
+    "error" text
+);
+
+-- migrate: up mysql
+
+CREATE TABLE IF NOT EXISTS migrations (
+    `revision` bigint NOT NULL,
+    `name` varchar(128) NOT NULL COMMENT 'The name of the migration parsed from the filename of the migration',
+    `active` boolean NOT NULL DEFAULT false COMMENT 'If the migration has been applied, set to false on rollbacks or if not applied',
+    `applied` timestamp(6) NULL COMMENT 'Timestamp when the migration was applied, null if rolledback or not applied',
+    `created` timestamp(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT 'Timestamp when the migration was created',
+    `checksum` varchar(64) COMMENT 'SHA-256 hash of the up and down sql when the migration was applied, null if not applied',
+    `progress` integer COMMENT 'Number of statements completed by a failed non-transactional migration, null otherwise',
+    PRIMARY KEY (`revision`)
+) COMMENT='Manages the state of database by enabling migrations and rollbacks';
+
+CREATE TABLE IF NOT EXISTS repeatable_migrations (
+    `name` varchar(128) NOT NULL COMMENT 'The name of the repeatable migration parsed from its R__name.sql filename',
+    `filename` varchar(255) NOT NULL COMMENT 'The filename of the repeatable migration when it was last applied',
+    `checksum` varchar(64) NOT NULL COMMENT 'SHA-256 hash of the sql of the repeatable migration when it was last applied',
+    `applied` timestamp(6) NOT NULL COMMENT 'Timestamp when the repeatable migration was last applied',
+    PRIMARY KEY (`name`)
+) COMMENT='Manages the state of repeatable migrations, which are re-applied when their sql changes';
+
+CREATE TABLE IF NOT EXISTS migration_history (
+    `id` bigint NOT NULL AUTO_INCREMENT COMMENT 'Sequential id of the entry in the log',
+    `revision` bigint COMMENT 'The revision of the migration, null for repeatable migrations',
+    `name` varchar(128) NOT NULL COMMENT 'The name of the migration',
+    `direction` varchar(4) NOT NULL COMMENT 'Either up if the migration was applied or down if it was rolled back',
+    `started` timestamp(6) NOT NULL COMMENT 'Timestamp when the migration started',
+    `duration_ms` bigint NOT NULL COMMENT 'Number of milliseconds the migration took to succeed or fail',
+    `version` varchar(32) NOT NULL COMMENT 'The version of catena that ran the migration',
+    `host` varchar(255) NOT NULL COMMENT 'The hostname of the machine that ran the migration',
+    `os_user` varchar(255) NOT NULL COMMENT 'The operating system user that ran the migration',
+    `success` boolean NOT NULL COMMENT 'If the migration succeeded',
+    `error` text COMMENT 'The error that caused the migration to fail, null if it succeeded',
+    PRIMARY KEY (`id`)
+) COMMENT='Append-only log of every migration that was applied or rolled back, including failures';
 
 -- NOTE: the down migration is run to complete reset the state of migrations if
--- something has gone completely sideways.
+-- something has gone completely sideways. The migration history is kept as an audit log.
 -- migrate: down
 
-DROP TABLE IF EXISTS migrations CASCADE;
\ No newline at end of file
+DROP TABLE IF EXISTS repeatable_migrations CASCADE;
+DROP TABLE IF EXISTS migrations CASCADE;
+
+-- migrate: down sqlite
+
+DROP TABLE IF EXISTS repeatable_migrations;
+DROP TABLE IF EXISTS migrations;
+
+-- migrate: down mysql
+
+DROP TABLE IF EXISTS repeatable_migrations;
+DROP TABLE IF EXISTS migrations;
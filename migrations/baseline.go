@@ -0,0 +1,359 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Baseline marks the migrations of the default migrator up to and including revision r
+// as applied without executing them.
+func Baseline(r int64, conn *sql.DB) (n int, err error) {
+	return std.Baseline(context.Background(), r, conn)
+}
+
+// Baseline marks the migrations up to and including revision r as applied without
+// executing them, e.g. for a database whose schema was created by hand before it was
+// managed by catena. Before anything is marked, the tables and columns that the
+// migrations would have created are checked against the database; if any of them are
+// missing, an error listing them is returned and nothing is changed. The expected
+// schema is inferred from the CREATE TABLE, ALTER TABLE and DROP TABLE statements of
+// the migrations; Go migrations and other statements cannot be checked. Returns the
+// number of migrations that were marked as applied.
+func (mg *Migrator) Baseline(ctx context.Context, r int64, conn *sql.DB) (n int, err error) {
+	if r <= 0 {
+		return 0, fmt.Errorf("cannot baseline revision %d", r)
+	}
+
+	mg.mu.Lock()
+	defer mg.mu.Unlock()
+
+	err = mg.withLock(ctx, conn, func(ctx context.Context, session *sql.Conn) (err error) {
+		var tx *sql.Tx
+		if tx, err = session.BeginTx(ctx, nil); err != nil {
+			return fmt.Errorf("could not begin baseline transaction: %s", err)
+		}
+		defer tx.Rollback()
+
+		if err = mg.refreshTx(ctx, tx); err != nil {
+			return err
+		}
+
+		if _, err = mg.revision(r); err != nil {
+			return err
+		}
+
+		for _, m := range mg.migrations[1:] {
+			if m.Revision > r && m.Active {
+				return fmt.Errorf("cannot baseline revision %d: revision %d has already been applied", r, m.Revision)
+			}
+		}
+
+		if err = mg.checkSchema(ctx, tx, r); err != nil {
+			return err
+		}
+
+		for i := 1; i < len(mg.migrations) && mg.migrations[i].Revision <= r; i++ {
+			if mg.migrations[i].Active {
+				continue
+			}
+
+			if mg.migrations[i].IsGo() {
+				mg.logger.Caution("marking go migration revision %d as applied without checking it", mg.migrations[i].Revision)
+			}
+
+			if err = mg.migrations[i].markApplied(ctx, tx); err != nil {
+				return err
+			}
+			mg.migrations[i].Active = true
+			n++
+		}
+
+		return tx.Commit()
+	})
+
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// Check that the tables and columns created by the migrations up to revision r exist.
+func (mg *Migrator) checkSchema(ctx context.Context, tx *sql.Tx, r int64) (err error) {
+	expected := make(schema)
+	for i := 1; i < len(mg.migrations) && mg.migrations[i].Revision <= r; i++ {
+		for _, stmt := range mg.migrations[i].statements(Up) {
+			expected.apply(stmt)
+		}
+	}
+
+	var missing []string
+	for _, table := range expected.tables() {
+		var columns []string
+		if columns, err = mg.dialect.Columns(ctx, tx, table); err != nil {
+			return fmt.Errorf("could not inspect table %s: %s", table, err)
+		}
+
+		if len(columns) == 0 {
+			missing = append(missing, fmt.Sprintf("table %s", table))
+			continue
+		}
+
+		actual := make(map[string]bool, len(columns))
+		for _, column := range columns {
+			actual[strings.ToLower(column)] = true
+		}
+
+		for _, column := range expected.columns(table) {
+			if !actual[strings.ToLower(column)] {
+				missing = append(missing, fmt.Sprintf("column %s.%s", table, column))
+			}
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("cannot baseline revision %d, the database is missing %s", r, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// schema maps the tables that the migrations create to the columns they contain.
+type schema map[string]map[string]struct{}
+
+// Returns the sorted names of the tables in the schema.
+func (s schema) tables() []string {
+	tables := make([]string, 0, len(s))
+	for table := range s {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	return tables
+}
+
+// Returns the sorted names of the columns of the table.
+func (s schema) columns(table string) []string {
+	columns := make([]string, 0, len(s[table]))
+	for column := range s[table] {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+	return columns
+}
+
+// Update the schema with the tables and columns that are created, renamed or dropped by
+// the statement. Statements that are not understood are ignored.
+func (s schema) apply(stmt statement) {
+	words, err := identifiers(stmt)
+	if err != nil || len(words) < 3 {
+		return
+	}
+
+	switch {
+	case words.match(0, "create"):
+		s.create(words)
+	case words.match(0, "alter", "table"):
+		s.alter(words[2:])
+	case words.match(0, "drop", "table"):
+		for i := words.skip(2, "if", "exists"); i < len(words) && words[i].text != ";"; {
+			if words[i].text == "," || words.isKeyword(i, "cascade", "restrict") {
+				i++
+				continue
+			}
+			delete(s, words.name(&i))
+		}
+	}
+}
+
+// CREATE [GLOBAL|LOCAL] [TEMP|TEMPORARY|UNLOGGED] TABLE [IF NOT EXISTS] name (columns)
+func (s schema) create(words identList) {
+	i := 1
+	for i < len(words) && !words.match(i, "table") {
+		if !words.isKeyword(i, "global", "local", "unlogged") {
+			// temporary tables and other objects are not checked
+			return
+		}
+		i++
+	}
+
+	i = words.skip(i+1, "if", "not", "exists")
+	if i >= len(words) {
+		return
+	}
+
+	table := words.name(&i)
+	s[table] = make(map[string]struct{})
+
+	// CREATE TABLE name AS SELECT has columns that cannot be inferred
+	if i >= len(words) || words[i].text != "(" {
+		return
+	}
+
+	for _, element := range words.split(i+1, ")") {
+		if len(element) == 0 || element.isKeyword(0, "constraint", "primary", "unique", "check", "foreign", "exclude", "like", "key", "index", "fulltext", "spatial") {
+			continue
+		}
+		s[table][element[0].text] = struct{}{}
+	}
+}
+
+// ALTER TABLE [IF EXISTS] [ONLY] name action [, action ...]
+func (s schema) alter(words identList) {
+	i := words.skip(0, "if", "exists")
+	i = words.skip(i, "only")
+	if i >= len(words) {
+		return
+	}
+
+	table := words.name(&i)
+	columns, ok := s[table]
+	if !ok {
+		// the table was not created by a migration so it cannot be checked
+		return
+	}
+
+	for _, action := range words.split(i, "") {
+		switch {
+		case action.match(0, "add"):
+			j := action.skip(1, "column")
+			j = action.skip(j, "if", "not", "exists")
+			if j < len(action) && !action.isKeyword(j, "constraint", "primary", "unique", "check", "foreign", "exclude", "key", "index", "fulltext", "spatial") {
+				columns[action[j].text] = struct{}{}
+			}
+		case action.match(0, "drop"):
+			j := action.skip(1, "column")
+			j = action.skip(j, "if", "exists")
+			if j < len(action) && (j > 1 || !action.isKeyword(j, "constraint", "primary", "index", "key", "foreign", "check")) {
+				delete(columns, action[j].text)
+			}
+		case action.match(0, "rename", "to"):
+			if len(action) > 2 {
+				delete(s, table)
+				j := 2
+				s[action.name(&j)] = columns
+			}
+		case action.match(0, "rename"):
+			j := action.skip(1, "column")
+			if j+2 < len(action) && action.match(j+1, "to") {
+				delete(columns, action[j].text)
+				columns[action[j+2].text] = struct{}{}
+			}
+		}
+	}
+}
+
+// An identifier or keyword token of a statement; keywords and unquoted identifiers are
+// lowercased and quoted identifiers are unquoted.
+type ident struct {
+	text   string
+	quoted bool
+}
+
+type identList []ident
+
+// Tokenize the statement into identifiers and punctuation, ignoring whitespace,
+// comments and strings.
+func identifiers(stmt statement) (words identList, err error) {
+	lex := stmt.lexer()
+	for {
+		var tok token
+		if tok, err = lex.next(); err != nil {
+			if errors.Is(err, io.EOF) {
+				return words, nil
+			}
+			return nil, err
+		}
+
+		switch tok.kind {
+		case tokenWord:
+			words = append(words, ident{text: strings.ToLower(tok.text)})
+		case tokenIdent:
+			if tok.text[0] == '`' {
+				// MySQL identifiers are case insensitive even when they are quoted
+				words = append(words, ident{text: strings.ToLower(strings.ReplaceAll(tok.text[1:len(tok.text)-1], "``", "`"))})
+				continue
+			}
+			words = append(words, ident{text: strings.ReplaceAll(tok.text[1:len(tok.text)-1], `""`, `"`), quoted: true})
+		case tokenPunct:
+			words = append(words, ident{text: tok.text})
+		}
+	}
+}
+
+// Returns true if the words starting at i are the specified unquoted keywords.
+func (w identList) match(i int, keywords ...string) bool {
+	if i+len(keywords) > len(w) {
+		return false
+	}
+	for j, keyword := range keywords {
+		if w[i+j].quoted || w[i+j].text != keyword {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns true if the word at i is any one of the unquoted keywords.
+func (w identList) isKeyword(i int, keywords ...string) bool {
+	for _, keyword := range keywords {
+		if w.match(i, keyword) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the index after the keywords if they are at i, otherwise returns i.
+func (w identList) skip(i int, keywords ...string) int {
+	if w.match(i, keywords...) {
+		return i + len(keywords)
+	}
+	return i
+}
+
+// Returns the possibly schema qualified name at *i without its schema, advancing *i.
+func (w identList) name(i *int) string {
+	name := w[*i].text
+	for *i++; *i+1 < len(w) && w[*i].text == "." && !w[*i].quoted; *i += 2 {
+		name = w[*i+1].text
+	}
+	return name
+}
+
+// Split the words starting at i on commas that are not nested in parentheses, stopping
+// at the closing token (or a semicolon) at the top level.
+func (w identList) split(i int, closing string) (parts []identList) {
+	var (
+		depth int
+		start = i
+	)
+
+	for ; i < len(w); i++ {
+		if w[i].quoted {
+			continue
+		}
+
+		switch w[i].text {
+		case "(":
+			depth++
+		case ")":
+			if depth == 0 && closing == ")" {
+				return append(parts, w[start:i])
+			}
+			depth--
+		case ",":
+			if depth == 0 {
+				parts = append(parts, w[start:i])
+				start = i + 1
+			}
+		case ";":
+			if depth == 0 {
+				return append(parts, w[start:i])
+			}
+		}
+	}
+	return append(parts, w[start:])
+}
@@ -0,0 +1,390 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Dialect encapsulates the differences between the databases that migrations can be
+// run against: how query parameters are bound, how the migrations lock is taken, and
+// which per-dialect sections of the migration files are executed. Migration files may
+// include sections such as "-- migrate: up sqlite" that are run instead of the generic
+// "-- migrate: up" section when the named dialect is in use.
+type Dialect interface {
+	// Name returns the name of the dialect used in migration file directives.
+	Name() string
+
+	// Placeholder returns the bind parameter for the nth (1-indexed) query argument.
+	Placeholder(n int) string
+
+	// TryLock attempts to acquire the lock of the named migrations table for the
+	// session without waiting.
+	TryLock(ctx context.Context, q Querier, table string) (bool, error)
+
+	// Unlock releases the lock of the named migrations table held by the session.
+	Unlock(ctx context.Context, q Querier, table string) error
+
+	// LockHolder describes the process that holds the lock of the named migrations table.
+	LockHolder(ctx context.Context, q Querier, table string) string
+
+	// Columns returns the columns of the table, or no columns if it does not exist.
+	Columns(ctx context.Context, q Querier, table string) ([]string, error)
+
+	// Timeouts returns the statements that set the lock and statement timeouts of the
+	// current transaction (if local) or session and the statements that reset them.
+	// Zero timeouts are not set; dialects that do not support a timeout ignore it.
+	Timeouts(lock, statement time.Duration, local bool) (set, reset []string)
+
+	// TimedOut returns true if the error was caused by a lock or statement timeout.
+	TimedOut(err error) bool
+
+	// Snapshot describes the tables of the schema with their columns, constraints and
+	// indices, excluding the tables used to manage migrations.
+	Snapshot(ctx context.Context, q Querier) (*Schema, error)
+}
+
+// Querier is implemented by *sql.DB, *sql.Conn, and *sql.Tx
+type Querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// The dialects that are supported by catena.
+var (
+	Postgres Dialect = postgres{}
+	SQLite   Dialect = sqlite{}
+	MySQL    Dialect = mysql{}
+)
+
+// SetDialect specifies the dialect of the database that migrations are run against by
+// the default migrator; by default migrations are run against PostgreSQL.
+func SetDialect(d Dialect) {
+	std.SetDialect(d)
+}
+
+// CurrentDialect returns the dialect of the database that migrations are run against by
+// the default migrator.
+func CurrentDialect() Dialect {
+	return std.Dialect()
+}
+
+// DialectFor returns the dialect with the specified name, which may also be a database
+// URL scheme or database/sql driver name such as "postgresql" or "sqlite3".
+func DialectFor(name string) (Dialect, error) {
+	switch strings.ToLower(name) {
+	case "postgres", "postgresql", "pq":
+		return Postgres, nil
+	case "sqlite", "sqlite3":
+		return SQLite, nil
+	case "mysql":
+		return MySQL, nil
+	default:
+		return nil, fmt.Errorf("unknown database dialect %q", name)
+	}
+}
+
+// Query a single column of strings, e.g. the names of the columns of a table.
+func queryStrings(ctx context.Context, q Querier, query string, args ...interface{}) (values []string, err error) {
+	var rows *sql.Rows
+	if rows, err = q.QueryContext(ctx, query, args...); err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var value string
+		if err = rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, rows.Err()
+}
+
+//===========================================================================
+// PostgreSQL
+//===========================================================================
+
+// The key of the advisory lock that serializes migrations across processes; it is the
+// big endian encoding of "ctna" so that it fits in the objid of pg_locks, which allows
+// us to look up the holder of the lock.
+const lockKey int64 = 0x63746e61
+
+// Returns the key of the advisory lock of the migrations table; tables other than the
+// default table use the FNV-1a hash of their name, which also fits in the objid.
+func advisoryLock(table string) int64 {
+	if table == DefaultTable {
+		return lockKey
+	}
+
+	hash := fnv.New32a()
+	hash.Write([]byte(table))
+	return int64(hash.Sum32())
+}
+
+type postgres struct{}
+
+func (postgres) Name() string {
+	return "postgres"
+}
+
+func (postgres) Placeholder(n int) string {
+	return "$" + strconv.Itoa(n)
+}
+
+func (postgres) TryLock(ctx context.Context, q Querier, table string) (locked bool, err error) {
+	err = q.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", advisoryLock(table)).Scan(&locked)
+	return locked, err
+}
+
+func (postgres) Unlock(ctx context.Context, q Querier, table string) (err error) {
+	_, err = q.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", advisoryLock(table))
+	return err
+}
+
+func (postgres) LockHolder(ctx context.Context, q Querier, table string) string {
+	var (
+		pid     int64
+		user    string
+		app     string
+		client  string
+		started time.Time
+	)
+
+	query := `SELECT a.pid, coalesce(a.usename, ''), coalesce(a.application_name, ''), coalesce(host(a.client_addr), 'local'), a.backend_start
+		FROM pg_locks l JOIN pg_stat_activity a ON a.pid = l.pid
+		WHERE l.locktype = 'advisory' AND l.granted AND l.classid = 0 AND l.objid = $1 AND l.objsubid = 1`
+
+	if err := q.QueryRowContext(ctx, query, advisoryLock(table)).Scan(&pid, &user, &app, &client, &started); err != nil {
+		return "an unknown process"
+	}
+
+	if app == "" {
+		app = "unnamed application"
+	}
+	return fmt.Sprintf("pid %d (%s@%s, %s) since %s", pid, user, client, app, started.Format(time.RFC3339))
+}
+
+func (postgres) Columns(ctx context.Context, q Querier, table string) ([]string, error) {
+	return queryStrings(ctx, q, "SELECT column_name FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = $1", table)
+}
+
+func (postgres) Timeouts(lock, statement time.Duration, local bool) (set, reset []string) {
+	for i, timeout := range []time.Duration{lock, statement} {
+		if timeout <= 0 {
+			continue
+		}
+
+		name := [...]string{"lock_timeout", "statement_timeout"}[i]
+
+		if local {
+			set = append(set, fmt.Sprintf("SET LOCAL %s = '%dms'", name, timeout.Milliseconds()))
+			reset = append(reset, fmt.Sprintf("SET LOCAL %s TO DEFAULT", name))
+		} else {
+			set = append(set, fmt.Sprintf("SET %s = '%dms'", name, timeout.Milliseconds()))
+			reset = append(reset, fmt.Sprintf("RESET %s", name))
+		}
+	}
+	return set, reset
+}
+
+// Timeouts are identified by their SQLSTATE rather than their message, which depends on
+// the locale and version of the server: lock_not_available (55P03) is raised by the lock
+// timeout and query_canceled (57014) by the statement timeout.
+func (postgres) TimedOut(err error) bool {
+	var pqerr *pq.Error
+	if !errors.As(err, &pqerr) {
+		return false
+	}
+	return pqerr.Code == "55P03" || pqerr.Code == "57014"
+}
+
+func (postgres) Snapshot(ctx context.Context, q Querier) (*Schema, error) {
+	query := `SELECT 'column', c.table_name, c.column_name, c.data_type || coalesce('(' || c.character_maximum_length || ')', '') || CASE WHEN c.is_nullable = 'NO' THEN ' NOT NULL' ELSE '' END || coalesce(' DEFAULT ' || c.column_default, '')
+		FROM information_schema.columns c JOIN information_schema.tables t ON t.table_schema = c.table_schema AND t.table_name = c.table_name
+		WHERE c.table_schema = current_schema() AND t.table_type = 'BASE TABLE'
+	UNION ALL
+	SELECT 'constraint', conrelid::regclass::text, conname, pg_get_constraintdef(oid)
+		FROM pg_constraint WHERE connamespace = current_schema()::regnamespace AND conrelid <> 0 AND contype <> 'n'
+	UNION ALL
+	SELECT 'index', tablename, indexname, indexdef FROM pg_indexes WHERE schemaname = current_schema()`
+	return scanSchema(ctx, q, query)
+}
+
+//===========================================================================
+// SQLite
+//===========================================================================
+
+// SQLite has no advisory locks, so the migrations lock is a row in a lock table that
+// identifies the process that holds it. If the process exits without releasing the
+// lock, the row must be deleted manually.
+type sqlite struct{}
+
+func (sqlite) Name() string {
+	return "sqlite"
+}
+
+func (sqlite) Placeholder(n int) string {
+	return "?" + strconv.Itoa(n)
+}
+
+func (sqlite) TryLock(ctx context.Context, q Querier, table string) (locked bool, err error) {
+	if _, err = q.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS "+table+"_lock (id integer PRIMARY KEY, holder text NOT NULL, acquired timestamp NOT NULL)"); err != nil {
+		return false, err
+	}
+
+	host, _ := os.Hostname()
+	holder := fmt.Sprintf("pid %d on %s", os.Getpid(), host)
+
+	var rows sql.Result
+	if rows, err = q.ExecContext(ctx, "INSERT OR IGNORE INTO "+table+"_lock (id, holder, acquired) VALUES (1, ?1, ?2)", holder, time.Now().UTC()); err != nil {
+		return false, err
+	}
+
+	var n int64
+	if n, err = rows.RowsAffected(); err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+func (sqlite) Unlock(ctx context.Context, q Querier, table string) (err error) {
+	_, err = q.ExecContext(ctx, "DELETE FROM "+table+"_lock WHERE id = 1")
+	return err
+}
+
+func (sqlite) LockHolder(ctx context.Context, q Querier, table string) string {
+	var (
+		holder   string
+		acquired time.Time
+	)
+
+	if err := q.QueryRowContext(ctx, "SELECT holder, acquired FROM "+table+"_lock WHERE id = 1").Scan(&holder, &acquired); err != nil {
+		return "an unknown process"
+	}
+	return fmt.Sprintf("%s since %s", holder, acquired.Format(time.RFC3339))
+}
+
+func (sqlite) Columns(ctx context.Context, q Querier, table string) ([]string, error) {
+	return queryStrings(ctx, q, "SELECT name FROM pragma_table_info(?1)", table)
+}
+
+// SQLite locks the entire database file and has no statement timeout, so migrations
+// rely on the busy timeout of the connection.
+func (sqlite) Timeouts(lock, statement time.Duration, local bool) (set, reset []string) {
+	return nil, nil
+}
+
+func (sqlite) TimedOut(err error) bool {
+	return strings.Contains(err.Error(), "database is locked")
+}
+
+func (sqlite) Snapshot(ctx context.Context, q Querier) (*Schema, error) {
+	query := `SELECT 'column', m.name, p.name, p.type || CASE WHEN p."notnull" THEN ' NOT NULL' ELSE '' END || coalesce(' DEFAULT ' || p.dflt_value, '')
+		FROM sqlite_master m JOIN pragma_table_info(m.name) p WHERE m.type = 'table' AND m.name NOT LIKE 'sqlite_%'
+	UNION ALL
+	SELECT 'constraint', m.name, m.name || '_pkey', 'PRIMARY KEY (' || group_concat(p.name, ', ') || ')'
+		FROM sqlite_master m JOIN pragma_table_info(m.name) p WHERE m.type = 'table' AND m.name NOT LIKE 'sqlite_%' AND p.pk > 0
+		GROUP BY m.name
+	UNION ALL
+	SELECT 'index', tbl_name, name, sql FROM sqlite_master WHERE type = 'index' AND sql IS NOT NULL`
+	return scanSchema(ctx, q, query)
+}
+
+//===========================================================================
+// MySQL
+//===========================================================================
+
+// Returns the name of the MySQL user lock that serializes migrations of the migrations
+// table across processes, e.g. catena_migrations.
+func lockName(table string) string {
+	return "catena_" + table
+}
+
+// MySQL implicitly commits DDL statements, so a failed migration containing DDL may be
+// partially applied even when it is run inside of a transaction. Connections must set
+// parseTime=true so that timestamps can be scanned.
+type mysql struct{}
+
+func (mysql) Name() string {
+	return "mysql"
+}
+
+func (mysql) Placeholder(n int) string {
+	return "?"
+}
+
+func (mysql) TryLock(ctx context.Context, q Querier, table string) (locked bool, err error) {
+	var result sql.NullInt64
+	if err = q.QueryRowContext(ctx, "SELECT GET_LOCK(?, 0)", lockName(table)).Scan(&result); err != nil {
+		return false, err
+	}
+	return result.Valid && result.Int64 == 1, nil
+}
+
+func (mysql) Unlock(ctx context.Context, q Querier, table string) (err error) {
+	var result sql.NullInt64
+	return q.QueryRowContext(ctx, "SELECT RELEASE_LOCK(?)", lockName(table)).Scan(&result)
+}
+
+func (mysql) LockHolder(ctx context.Context, q Querier, table string) string {
+	var (
+		id   int64
+		user string
+		host string
+		secs int64
+	)
+
+	query := "SELECT id, user, host, time FROM information_schema.processlist WHERE id = IS_USED_LOCK(?)"
+	if err := q.QueryRowContext(ctx, query, lockName(table)).Scan(&id, &user, &host, &secs); err != nil {
+		return "an unknown process"
+	}
+	return fmt.Sprintf("connection %d (%s@%s) for %s", id, user, host, time.Duration(secs)*time.Second)
+}
+
+func (mysql) Columns(ctx context.Context, q Querier, table string) ([]string, error) {
+	return queryStrings(ctx, q, "SELECT column_name FROM information_schema.columns WHERE table_schema = database() AND table_name = ?", table)
+}
+
+// MySQL has no transaction scoped settings, so the timeouts are always set on the
+// session. Lock timeouts are in whole seconds and apply both to row locks and to the
+// metadata locks taken by DDL. Statement timeouts are not supported and are ignored,
+// since max_execution_time only applies to SELECT statements and so would not limit the
+// DDL and DML that migrations run.
+func (mysql) Timeouts(lock, statement time.Duration, local bool) (set, reset []string) {
+	if lock > 0 {
+		secs := int64(math.Ceil(lock.Seconds()))
+		set = append(set, fmt.Sprintf("SET SESSION lock_wait_timeout = %d", secs), fmt.Sprintf("SET SESSION innodb_lock_wait_timeout = %d", secs))
+		reset = append(reset, "SET SESSION lock_wait_timeout = DEFAULT", "SET SESSION innodb_lock_wait_timeout = DEFAULT")
+	}
+	return set, reset
+}
+
+func (mysql) TimedOut(err error) bool {
+	return strings.Contains(err.Error(), "Lock wait timeout exceeded")
+}
+
+func (mysql) Snapshot(ctx context.Context, q Querier) (*Schema, error) {
+	query := `SELECT 'column', c.table_name, c.column_name, concat(c.column_type, if(c.is_nullable = 'NO', ' NOT NULL', ''), coalesce(concat(' DEFAULT ', c.column_default), ''))
+		FROM information_schema.columns c JOIN information_schema.tables t ON t.table_schema = c.table_schema AND t.table_name = c.table_name
+		WHERE c.table_schema = database() AND t.table_type = 'BASE TABLE'
+	UNION ALL
+	SELECT 'constraint', table_name, constraint_name, constraint_type
+		FROM information_schema.table_constraints WHERE table_schema = database()
+	UNION ALL
+	SELECT 'index', table_name, index_name, concat('CREATE ', if(non_unique = 0, 'UNIQUE ', ''), 'INDEX ', index_name, ' ON ', table_name, ' (', group_concat(column_name ORDER BY seq_in_index SEPARATOR ', '), ')')
+		FROM information_schema.statistics WHERE table_schema = database()
+		GROUP BY table_name, index_name, non_unique`
+	return scanSchema(ctx, q, query)
+}
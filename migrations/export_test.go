@@ -0,0 +1,24 @@
+package migrations
+
+import "testing"
+
+// Isolate unregisters all migrations other than the migrations schema from the default
+// migrator for the duration of the test and restores its settings afterwards so that
+// tests can register migrations and change options without affecting each other.
+func Isolate(t *testing.T) {
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	registered, repeated, opts := std.migrations, std.repeatables, std.opts
+	std.migrations, std.repeatables = []Migration{registered[0]}, nil
+	t.Cleanup(func() {
+		std.mu.Lock()
+		defer std.mu.Unlock()
+		std.migrations, std.repeatables, std.opts = registered, repeated, opts
+	})
+}
+
+// RenameTables exposes the rewriting of the bookkeeping tables of a migrator's queries.
+func RenameTables(mg *Migrator, query string) string {
+	return mg.renameTables(newLexer(query))
+}
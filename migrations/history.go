@@ -0,0 +1,129 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"os/user"
+	"time"
+)
+
+// Record is an entry of the append-only migration history, which logs every migration
+// that was applied or rolled back by Migrate along with who ran it and whether it
+// succeeded. Unlike the migrations table, the history is never updated, so it describes
+// what happened to the database even after migrations have been rolled back.
+type Record struct {
+	ID         int64
+	Revision   int64
+	Name       string
+	Repeatable bool
+	Direction  Direction
+	Started    time.Time
+	Duration   time.Duration
+	Version    string
+	Host       string
+	User       string
+	Success    bool
+	Error      string
+}
+
+// History returns the most recent records of the migration history of the default
+// migrator, newest first.
+func History(conn *sql.DB, limit int) (records []Record, err error) {
+	return std.History(context.Background(), conn, limit)
+}
+
+// History returns the most recent records of the migration history, newest first. If
+// limit is zero or negative, the entire history is returned.
+func (mg *Migrator) History(ctx context.Context, conn *sql.DB, limit int) (records []Record, err error) {
+	mg.mu.Lock()
+	defer mg.mu.Unlock()
+
+	if err = mg.refresh(ctx, conn); err != nil {
+		return nil, err
+	}
+
+	query := mg.rebind("SELECT id, revision, name, direction, started, duration_ms, version, host, os_user, success, error FROM migration_history ORDER BY id DESC")
+	if limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", limit)
+	}
+
+	var rows *sql.Rows
+	if rows, err = conn.QueryContext(ctx, query); err != nil {
+		return nil, fmt.Errorf("could not query migration history: %s", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			rec       Record
+			revision  sql.NullInt64
+			direction string
+			duration  int64
+			failure   sql.NullString
+		)
+
+		if err = rows.Scan(&rec.ID, &revision, &rec.Name, &direction, &rec.Started, &duration, &rec.Version, &rec.Host, &rec.User, &rec.Success, &failure); err != nil {
+			return nil, fmt.Errorf("could not scan migration history: %s", err)
+		}
+
+		rec.Revision, rec.Repeatable = revision.Int64, !revision.Valid
+		rec.Duration = time.Duration(duration) * time.Millisecond
+		rec.Error = failure.String
+
+		switch direction {
+		case "up":
+			rec.Direction = Up
+		case "down":
+			rec.Direction = Down
+		}
+
+		records = append(records, rec)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("could not read migration history: %s", err)
+	}
+	return records, nil
+}
+
+// Append the outcome of the step to the migration history. Successful transactional
+// steps are recorded in the migration transaction so that the record is rolled back
+// with the migration, failures are recorded on the session after the failed transaction
+// has been rolled back so that they are kept.
+func (s *Step) record(ctx context.Context, q Querier, started time.Time, failure error) (err error) {
+	var revision, errmsg interface{}
+	if !s.repeatable {
+		revision = s.Revision
+	}
+	if failure != nil {
+		errmsg = failure.Error()
+	}
+
+	host, _ := os.Hostname()
+	query := s.migrator().rebind("INSERT INTO migration_history (revision, name, direction, started, duration_ms, version, host, os_user, success, error) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)")
+	if _, err = q.ExecContext(ctx, query, revision, s.Name, s.Direction.String(), started.UTC(), time.Since(started).Milliseconds(), s.migrator().options().Version, host, osUser(), failure == nil, errmsg); err != nil {
+		return fmt.Errorf("could not record %s in migration history: %s", s.ref(), err)
+	}
+	return nil
+}
+
+// Record a failed step, logging rather than returning an error if it cannot be recorded
+// so that the error of the step is what is reported.
+func (s *Step) recordFailure(ctx context.Context, q Querier, started time.Time, failure error) {
+	if err := s.record(ctx, q, started, failure); err != nil {
+		s.migrator().logger.Warn("%s", err)
+	}
+}
+
+// Returns the name of the operating system user running the process.
+func osUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	if name := os.Getenv("USER"); name != "" {
+		return name
+	}
+	return "unknown"
+}
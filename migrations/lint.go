@@ -0,0 +1,234 @@
+package migrations
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Severity describes how serious a lint issue is.
+type Severity uint8
+
+// Lint issue severities
+const (
+	Warning Severity = iota + 1
+	Error
+)
+
+func (s Severity) String() string {
+	switch s {
+	case Warning:
+		return "warning"
+	case Error:
+		return "error"
+	default:
+		return "unknown"
+	}
+}
+
+// Lint rules that are checked by Lint. An issue can be allowed by adding a marker
+// comment such as "-- lint: allow drop-column" before or inside of the statement.
+const (
+	RuleDropTable         = "drop-table"          // dropping a table destroys data
+	RuleDropColumn        = "drop-column"         // dropping a column destroys data
+	RuleNotNullNoDefault  = "not-null-no-default" // adding a NOT NULL column without a default fails on existing rows
+	RuleTypeChange        = "type-change"         // changing the type of a column may rewrite the table under lock
+	RuleIndexConcurrently = "index-concurrently"  // creating an index without CONCURRENTLY blocks writes
+	RuleMissingDown       = "missing-down"        // the migration cannot be rolled back
+)
+
+// Issue is a potential problem with a migration found by Lint.
+type Issue struct {
+	Filename string
+	Line     int
+	Rule     string
+	Severity Severity
+	Message  string
+}
+
+func (i Issue) String() string {
+	return fmt.Sprintf("%s:%d: %s: %s (%s)", i.Filename, i.Line, i.Severity, i.Message, i.Rule)
+}
+
+// Lint statically analyzes the up statements of the migration for destructive
+// operations and operations that hold long locks, as well as checking that the
+// migration has a down section. Indices that are created without CONCURRENTLY on a
+// table created by an earlier migration are warnings, or errors if the table is one of
+// the specified large tables where blocking writes would cause an outage. Go migrations
+// are not linted.
+func Lint(m *Migration, large ...string) (issues []Issue) {
+	if m.IsGo() {
+		return nil
+	}
+
+	isLarge := make(map[string]bool, len(large))
+	for _, table := range large {
+		isLarge[strings.ToLower(table)] = true
+	}
+
+	// tables created by the migration can be modified without locking anyone out
+	created := make(map[string]bool)
+
+	report := func(stmt statement, rule string, severity Severity, format string, args ...interface{}) {
+		if !stmt.allows(rule) {
+			issues = append(issues, Issue{
+				Filename: m.filename,
+				Line:     stmt.line,
+				Rule:     rule,
+				Severity: severity,
+				Message:  fmt.Sprintf(format, args...),
+			})
+		}
+	}
+
+	for _, stmt := range m.statements(Up) {
+		words, err := identifiers(stmt)
+		if err != nil || len(words) < 3 {
+			continue
+		}
+
+		switch {
+		case words.match(0, "create") && words.isKeyword(1, "table", "unlogged", "temp", "temporary"):
+			i := 1
+			for i < len(words) && !words.match(i, "table") {
+				i++
+			}
+			i = words.skip(i+1, "if", "not", "exists")
+			if i < len(words) {
+				created[words.name(&i)] = true
+			}
+
+		case words.match(0, "create", "index") || words.match(0, "create", "unique", "index"):
+			i := words.skip(1, "unique") + 1
+			if words.match(i, "concurrently") {
+				continue
+			}
+
+			// skip the optional index name to find the table the index is on
+			for i < len(words) && !words.match(i, "on") {
+				i++
+			}
+			i = words.skip(i+1, "only")
+			if i >= len(words) {
+				continue
+			}
+
+			table := words.name(&i)
+			switch {
+			case created[table]:
+			case isLarge[table]:
+				report(stmt, RuleIndexConcurrently, Error, "creating an index on large table %s without CONCURRENTLY blocks writes", table)
+			default:
+				report(stmt, RuleIndexConcurrently, Warning, "creating an index on %s without CONCURRENTLY blocks writes", table)
+			}
+
+		case words.match(0, "drop", "table"):
+			report(stmt, RuleDropTable, Error, "dropping a table destroys its data")
+
+		case words.match(0, "alter", "table"):
+			i := words.skip(2, "if", "exists")
+			i = words.skip(i, "only")
+			if i >= len(words) {
+				continue
+			}
+
+			table := words.name(&i)
+			for _, action := range words.split(i, "") {
+				lintAlter(stmt, table, action, created[table], report)
+			}
+		}
+	}
+
+	if len(m.statements(Down)) == 0 {
+		issues = append(issues, Issue{
+			Filename: m.filename,
+			Line:     1,
+			Rule:     RuleMissingDown,
+			Severity: Warning,
+			Message:  "the migration has no down statements so it cannot be rolled back",
+		})
+	}
+
+	return issues
+}
+
+// Lint a single action of an ALTER TABLE statement.
+func lintAlter(stmt statement, table string, action identList, created bool, report func(statement, string, Severity, string, ...interface{})) {
+	switch {
+	case action.match(0, "drop"):
+		j := action.skip(1, "column")
+		j = action.skip(j, "if", "exists")
+		if j < len(action) && (j > 1 || !action.isKeyword(j, "constraint", "primary", "index", "key", "foreign", "check")) {
+			report(stmt, RuleDropColumn, Error, "dropping column %s.%s destroys its data", table, action[j].text)
+		}
+
+	case action.match(0, "add"):
+		j := action.skip(1, "column")
+		j = action.skip(j, "if", "not", "exists")
+		if created || j >= len(action) || action.isKeyword(j, "constraint", "primary", "unique", "check", "foreign", "exclude", "key", "index") {
+			return
+		}
+
+		var notnull, defaulted bool
+		for k := j + 1; k < len(action); k++ {
+			notnull = notnull || (action.match(k, "not", "null"))
+			defaulted = defaulted || action.match(k, "default")
+		}
+
+		if notnull && !defaulted {
+			report(stmt, RuleNotNullNoDefault, Error, "adding NOT NULL column %s.%s without a default fails if the table has rows", table, action[j].text)
+		}
+
+	case action.match(0, "alter"):
+		j := action.skip(1, "column")
+		if created || j+1 >= len(action) {
+			return
+		}
+
+		if action.match(j+1, "type") || action.match(j+1, "set", "data", "type") {
+			report(stmt, RuleTypeChange, Error, "changing the type of %s.%s may rewrite the table while holding an exclusive lock", table, action[j].text)
+		}
+
+	case action.isKeyword(0, "modify", "change"):
+		// MySQL syntax for changing the definition of a column
+		j := action.skip(1, "column")
+		if !created && j < len(action) {
+			report(stmt, RuleTypeChange, Error, "changing the definition of %s.%s may rewrite the table while holding an exclusive lock", table, action[j].text)
+		}
+	}
+}
+
+// Returns true if a "-- lint: allow rule" marker precedes or is inside the statement.
+func (s statement) allows(rule string) bool {
+	comments := append([]string{}, s.comments...)
+
+	lex := s.lexer()
+	for {
+		tok, err := lex.next()
+		if err != nil {
+			break
+		}
+		if tok.kind == tokenComment {
+			comments = append(comments, tok.text)
+		}
+	}
+
+	for _, comment := range comments {
+		comment = strings.ToLower(strings.Trim(comment, "-/* \t\r\n"))
+		if !strings.HasPrefix(comment, "lint:") {
+			continue
+		}
+
+		fields := strings.FieldsFunc(strings.TrimPrefix(comment, "lint:"), func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t'
+		})
+
+		if len(fields) > 1 && fields[0] == "allow" {
+			for _, allowed := range fields[1:] {
+				if allowed == rule {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
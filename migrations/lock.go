@@ -0,0 +1,123 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/bbengfort/catena/logs"
+)
+
+// How often to retry acquiring the migrations lock while it is held elsewhere.
+const lockPoll = 250 * time.Millisecond
+
+// SetLogger replaces the logger used by the default migrator.
+func SetLogger(l *logs.Logger) {
+	std.SetLogger(l)
+}
+
+// Unlock releases the migrations lock of the default migrator that was left behind by a
+// process that exited while holding it.
+func Unlock(conn *sql.DB) (released bool, err error) {
+	return std.Unlock(context.Background(), conn)
+}
+
+// Unlock releases a migrations lock that was left behind by a process that exited while
+// holding it and returns false if the lock was not held. Only the lock row of SQLite can
+// outlive the process that holds it; the advisory and named locks of Postgres and MySQL
+// are released by the database when the session that holds them ends and cannot be
+// released by another session, so an error is returned for them instead. The lock must
+// not be released while the process that holds it is still migrating.
+func (mg *Migrator) Unlock(ctx context.Context, conn *sql.DB) (released bool, err error) {
+	mg.mu.RLock()
+	defer mg.mu.RUnlock()
+
+	if mg.dialect != SQLite {
+		return false, fmt.Errorf("the %s migrations lock is released when the session that holds it ends and cannot be released by another process", mg.dialect.Name())
+	}
+
+	var locked bool
+	if locked, err = mg.dialect.TryLock(ctx, conn, mg.table); err != nil {
+		return false, fmt.Errorf("could not check migrations lock: %s", err)
+	}
+
+	if !locked {
+		mg.logger.Caution("releasing migrations lock held by %s", mg.dialect.LockHolder(ctx, conn, mg.table))
+	}
+
+	if err = mg.dialect.Unlock(ctx, conn, mg.table); err != nil {
+		return false, fmt.Errorf("could not release migrations lock: %s", err)
+	}
+	return !locked, nil
+}
+
+// Run fn on a dedicated connection that holds the migrations lock for the duration of
+// the call, waiting up to the LockWait of the migrator for other processes that are
+// migrating or refreshing the database to finish. The lock is held by the connection's
+// session rather than by a transaction, e.g. with pg_advisory_lock rather than
+// pg_advisory_xact_lock, since a transaction level lock is released when its transaction
+// commits, whereas Migrate commits each migration in its own transaction and runs
+// non-transactional migrations outside of a transaction. Session locks are released by
+// the database if the process exits, except for the lock row of SQLite, which is left
+// behind until it is released with Unlock.
+func (mg *Migrator) withLock(ctx context.Context, conn *sql.DB, fn func(context.Context, *sql.Conn) error) error {
+	return withSession(ctx, conn, func(ctx context.Context, session *sql.Conn) (err error) {
+		if err = mg.lockSession(ctx, session); err != nil {
+			return err
+		}
+		// the lock is released even if the context was canceled so it is not held by a
+		// connection that is returned to the pool
+		defer mg.unlockSession(context.Background(), session)
+		return fn(ctx, session)
+	})
+}
+
+// Acquire the migrations lock for the connection's session. The lock must be released
+// with unlockSession before the connection is returned to the pool. Waiting for the lock
+// is abandoned if the context is canceled.
+func (mg *Migrator) lockSession(ctx context.Context, conn *sql.Conn) (err error) {
+	var locked bool
+	wait := mg.options().LockWait
+	deadline := time.Now().Add(wait)
+
+	for waiting := false; ; waiting = true {
+		if locked, err = mg.dialect.TryLock(ctx, conn, mg.table); err != nil {
+			return fmt.Errorf("could not acquire migrations lock: %s", err)
+		}
+
+		if locked {
+			if waiting {
+				mg.logger.Info("acquired migrations lock")
+			}
+			return nil
+		}
+
+		holder := mg.dialect.LockHolder(ctx, conn, mg.table)
+		if time.Now().After(deadline) {
+			// only the lock row of sqlite outlives the process that holds it
+			if mg.dialect == SQLite {
+				holder += " (release it with Unlock, e.g. catena db:unlock, if the process has exited)"
+			}
+			return fmt.Errorf("timed out after %s waiting for migrations lock held by %s", wait, holder)
+		}
+
+		if !waiting {
+			mg.logger.Caution("waiting up to %s for migrations lock held by %s", wait, holder)
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("stopped waiting for migrations lock held by %s: %s", holder, ctx.Err())
+		case <-time.After(lockPoll):
+		}
+	}
+}
+
+// Release the session level migrations lock.
+func (mg *Migrator) unlockSession(ctx context.Context, conn *sql.Conn) (err error) {
+	if err = mg.dialect.Unlock(ctx, conn, mg.table); err != nil {
+		return fmt.Errorf("could not release migrations lock: %s", err)
+	}
+	return nil
+}
@@ -1,19 +1,21 @@
 /*
 Package migrations manages the state of the Catena database. SQL files should be added
 to this directory that implement DDL commands that update the schema of the database
-that Catena is connected to. The SQL files are then compiled into the binary using the
-catena makemigrations command along with go generate. The catena server and command can
-compare the state of the database with its expected state and run any migrations that
-are required.
+that Catena is connected to. The SQL files are embedded into the binary with go:embed
+and registered when the package is initialized; applications that embed catena can
+register migrations from their own fs.FS sources as well. The catena server and command
+can compare the state of the database with its expected state and run any migrations
+that are required.
 */
 package migrations
 
-//go:generate go run ../cmd/makemigrations
-
 import (
-	"bufio"
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"database/sql"
+	"embed"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"os"
@@ -28,98 +30,193 @@ import (
 // weak sauce helper for debugging
 var debug = false
 
-// contains all of the available migrations generated by go generate and added in the
-// init function of the file migrations.go (the file generated by go generate).
-var migrations []Migration
+// the migration files in this directory, embedded into the binary
+//
+//go:embed *.sql
+var embedded embed.FS
+
+func init() {
+	if err := std.Register(embedded); err != nil {
+		panic(err)
+	}
+}
 
 // External API
 
+// Migrate the database to the specified revision with the default migrator.
+func Migrate(r int64, conn *sql.DB) (n int, err error) {
+	return std.Migrate(context.Background(), r, conn)
+}
+
 // Migrate the database to the specified revision, if the revision is negative,
-// then apply all unapplied migrations to the database. If the revision is less than
+// then apply all unapplied migrations to the database followed by any repeatable
+// migrations that are new or have changed since they were last applied. If the revision is less than
 // the current revision, then the database is rolled back to that state. This function
 // cannot drop the migrations table, use the Delete() function to completely rollback
-// all migrations and delete the migrations table. Returns the total number of
-// migrations that were executed against the database.
-func Migrate(r int64, conn *sql.DB) (n int, err error) {
+// all migrations and delete the migrations table. Use Plan to inspect the migrations
+// that will be applied or rolled back before running them. Returns the total number of
+// migrations that were executed against the database. Concurrent calls to Migrate or
+// Refresh from other processes are serialized with a database lock; if the lock cannot
+// be acquired within the LockWait of the migrator an error is returned.
+//
+// Migrations are executed together in a single transaction unless the plan contains
+// migrations with the "-- migrate: no-transaction" directive. These are executed
+// outside of a transaction and split the run into batches: each batch of transactional
+// migrations is committed before the next non-transactional migration is run. If an
+// error occurs, the migrations that were committed before it remain applied and are
+// included in the returned count; the progress of a failed non-transactional migration
+// is recorded so that the next call to Migrate resumes it with the failed statement.
+// Every step that is executed, including a step that fails, is appended to the
+// migration history that is returned by History. If a step is canceled by its lock or
+// statement timeout, a *TimeoutError is returned and Migrate can be retried.
+func (mg *Migrator) Migrate(ctx context.Context, r int64, conn *sql.DB) (n int, err error) {
+	mg.mu.Lock()
+	defer mg.mu.Unlock()
+
+	// All work is done on a single connection that holds the lock for the whole run so
+	// that no other process is migrating the database at the same time.
+	err = mg.withLock(ctx, conn, func(ctx context.Context, session *sql.Conn) error {
+		var merr error
+		n, merr = mg.migrate(ctx, r, session)
+		return merr
+	})
+	return n, err
+}
+
+func (mg *Migrator) migrate(ctx context.Context, r int64, session *sql.Conn) (n int, err error) {
+	// Refresh the database and also apply the 0 migration (initialization). The run is
+	// split into several transactions by non-transactional migrations, so whichever
+	// transaction is open when the run fails is rolled back.
 	var tx *sql.Tx
-	if tx, err = conn.Begin(); err != nil {
+	if tx, err = session.BeginTx(ctx, nil); err != nil {
 		return 0, fmt.Errorf("could not begin migration transaction: %s", err)
 	}
-	defer tx.Rollback()
+	defer func() {
+		if tx != nil {
+			tx.Rollback()
+		}
+	}()
 
-	// Refresh the database and also apply the 0 migration (initialization).
-	if err = refreshTx(tx); err != nil {
+	if err = mg.refreshTx(ctx, tx); err != nil {
 		return 0, err
 	}
 
-	// There are no migrations except the initialization migration.
-	if len(migrations) == 1 {
-		return 0, nil
-	}
+	// Migration 0 has already been applied, so execute the plan for all others.
+	var batch int
+	for _, step := range mg.plan(r) {
+		if step.notx {
+			// Commit the transactional migrations before running outside of the transaction
+			if err = tx.Commit(); err != nil {
+				return n, fmt.Errorf("could not commit %d migrations: %s", batch, err)
+			}
+			n += batch
+			batch = 0
+
+			started := time.Now()
+			if err = step.execConn(ctx, session); err != nil {
+				err = step.timedOut(err)
+				step.recordFailure(ctx, session, started, err)
+				return n, err
+			}
 
-	// Migration 0 has already been applied, so skip it and apply all others.
-	for _, m := range migrations[1:] {
-		if r < 0 || m.Revision <= r {
-			if !m.Active {
-				if err = m.upTx(tx); err != nil {
-					return 0, fmt.Errorf("could not apply revision %d: %s", m.Revision, err)
-				}
-				n++
+			if err = step.record(ctx, session, started, nil); err != nil {
+				return n, err
 			}
-		} else if r >= 0 && m.Revision > r {
-			if m.Active {
-				if err = m.downTx(tx); err != nil {
-					return 0, fmt.Errorf("could not rollback revision %d: %s", m.Revision, err)
-				}
-				n++
+			n++
+
+			if tx, err = session.BeginTx(ctx, nil); err != nil {
+				return n, fmt.Errorf("could not begin migration transaction: %s", err)
 			}
+			continue
 		}
+
+		started := time.Now()
+		if err = step.execTx(ctx, tx); err != nil {
+			// the failure is recorded outside of the failed transaction so that it is kept
+			tx.Rollback()
+			err = step.timedOut(err)
+			step.recordFailure(ctx, session, started, err)
+			return n, err
+		}
+
+		if err = step.record(ctx, tx, started, nil); err != nil {
+			return n, err
+		}
+		batch++
 	}
 
 	if err = tx.Commit(); err != nil {
-		return 0, fmt.Errorf("could not commit %d migrations: %s", n, err)
+		return n, fmt.Errorf("could not commit %d migrations: %s", batch, err)
 	}
 
-	return n, nil
+	return n + batch, nil
 }
 
-// Num returns the number of migrations in the package
+// Num returns the number of migrations registered with the default migrator.
 func Num() int {
-	return len(migrations)
+	return std.Num()
+}
+
+// Num returns the number of registered migrations, including the migrations schema.
+func (mg *Migrator) Num() int {
+	mg.mu.RLock()
+	defer mg.mu.RUnlock()
+	return len(mg.migrations)
 }
 
-// Revision returns the migration for the specified revision.
+// Revision returns the migration for the specified revision from the default migrator.
 func Revision(r int64, conn *sql.DB) (Migration, error) {
+	return std.Revision(context.Background(), r, conn)
+}
+
+// Revision returns the migration for the specified revision. If conn is not nil, the
+// state of the migrations is refreshed from the database first.
+func (mg *Migrator) Revision(ctx context.Context, r int64, conn *sql.DB) (Migration, error) {
+	mg.mu.Lock()
+	defer mg.mu.Unlock()
+
 	if conn != nil {
-		if err := Refresh(conn); err != nil {
+		if err := mg.refresh(ctx, conn); err != nil {
 			return Migration{}, err
 		}
 	}
+	return mg.revision(r)
+}
 
-	i := sort.Search(len(migrations), func(i int) bool {
-		return r <= migrations[i].Revision
+func (mg *Migrator) revision(r int64) (Migration, error) {
+	i := sort.Search(len(mg.migrations), func(i int) bool {
+		return r <= mg.migrations[i].Revision
 	})
 
-	if i < len(migrations) && migrations[i].Revision == r {
-		return migrations[i], nil
+	if i < len(mg.migrations) && mg.migrations[i].Revision == r {
+		return mg.migrations[i], nil
 	}
 	return Migration{}, fmt.Errorf("no migration found for revision %d", r)
 }
 
-// Current returns the most recently applied revision.
+// Current returns the most recently applied revision from the default migrator.
 func Current(conn *sql.DB) (Migration, error) {
+	return std.Current(context.Background(), conn)
+}
+
+// Current returns the most recently applied revision. If conn is not nil, the state of
+// the migrations is refreshed from the database first.
+func (mg *Migrator) Current(ctx context.Context, conn *sql.DB) (Migration, error) {
+	mg.mu.Lock()
+	defer mg.mu.Unlock()
+
 	if conn != nil {
-		if err := Refresh(conn); err != nil {
+		if err := mg.refresh(ctx, conn); err != nil {
 			return Migration{}, err
 		}
 	}
 
-	if !migrations[0].dbsync {
+	if !mg.migrations[0].dbsync {
 		return Migration{}, errors.New("migrations have not been synchronized with the database")
 	}
 
 	var current Migration
-	for _, m := range migrations {
+	for _, m := range mg.migrations {
 		if !m.Active {
 			break
 		}
@@ -129,79 +226,225 @@ func Current(conn *sql.DB) (Migration, error) {
 	return current, nil
 }
 
-// Refresh the state of the migrations from the database.
+// Refresh the state of the migrations of the default migrator from the database.
 func Refresh(conn *sql.DB) (err error) {
-	var tx *sql.Tx
-	if tx, err = conn.Begin(); err != nil {
-		return fmt.Errorf("could not begin refresh transaction: %s", err)
-	}
-	defer tx.Rollback()
+	return std.Refresh(context.Background(), conn)
+}
 
-	if err = refreshTx(tx); err != nil {
-		return err
+// Refresh the state of the migrations from the database.
+func (mg *Migrator) Refresh(ctx context.Context, conn *sql.DB) (err error) {
+	mg.mu.Lock()
+	defer mg.mu.Unlock()
+	return mg.refresh(ctx, conn)
+}
+
+func (mg *Migrator) refresh(ctx context.Context, conn *sql.DB) (err error) {
+	return mg.withLock(ctx, conn, func(ctx context.Context, session *sql.Conn) (err error) {
+		var tx *sql.Tx
+		if tx, err = session.BeginTx(ctx, nil); err != nil {
+			return fmt.Errorf("could not begin refresh transaction: %s", err)
+		}
+		defer tx.Rollback()
+
+		if err = mg.refreshTx(ctx, tx); err != nil {
+			return err
+		}
+
+		return tx.Commit()
+	})
+}
+
+// Verify the migrations of the default migrator against the database.
+func Verify(conn *sql.DB) (modified []Migration, err error) {
+	return std.Verify(context.Background(), conn)
+}
+
+// Verify refreshes the state of the migrations from the database and returns any
+// applied migrations whose up or down SQL no longer matches the checksum that was
+// stored when the migration was applied, e.g. because the SQL file was edited after
+// the migration was run. An error is only returned if the database cannot be read.
+func (mg *Migrator) Verify(ctx context.Context, conn *sql.DB) (modified []Migration, err error) {
+	mg.mu.Lock()
+	defer mg.mu.Unlock()
+
+	if err = mg.refresh(ctx, conn); err != nil {
+		return nil, err
 	}
 
-	return tx.Commit()
+	for _, m := range mg.migrations {
+		if m.Modified() {
+			modified = append(modified, m)
+		}
+	}
+	return modified, nil
 }
 
-func refreshTx(tx *sql.Tx) (err error) {
+func (mg *Migrator) refreshTx(ctx context.Context, tx *sql.Tx) (err error) {
 	// Apply migration 0 which initializes the migration schema
-	if err = migrations[0].upTx(tx); err != nil {
+	if err = mg.migrations[0].upTx(ctx, tx); err != nil {
 		return err
 	}
 
 	var rows *sql.Rows
-	if rows, err = tx.Query("SELECT revision, name, active, applied, created FROM migrations ORDER BY revision"); err != nil {
+	if rows, err = tx.QueryContext(ctx, mg.rebind("SELECT revision, name, active, applied, created, checksum, progress FROM migrations ORDER BY revision")); err != nil {
 		return fmt.Errorf("could not fetch migrations: %s", err)
 	}
 	defer rows.Close()
 
-	var i int
+	// local migrations are matched to the database by revision rather than by position
+	// since migrations with earlier revisions may be merged after later ones were applied
+	local := make(map[int64]int, len(mg.migrations))
+	for j := range mg.migrations {
+		local[mg.migrations[j].Revision] = j
+
+		// state from an earlier refresh may have been rolled back, e.g. by Plan
+		mg.migrations[j].Active, mg.migrations[j].Applied = false, time.Time{}
+		mg.migrations[j].checksum, mg.migrations[j].progress = "", 0
+		mg.migrations[j].dbsync = false
+	}
+
+	var (
+		absorbed = make(map[int]int64) // the latest active revision squashed into each local baseline
+		adopted  []int                 // baselines that were applied as the migrations they replaced
+	)
+
 	for rows.Next() {
+		var (
+			applied  sql.NullTime
+			checksum sql.NullString
+			progress sql.NullInt64
+		)
+
 		mr := new(Migration)
-		if err = rows.Scan(&mr.Revision, &mr.Name, &mr.Active, &mr.Applied, &mr.Created); err != nil {
+		if err = rows.Scan(&mr.Revision, &mr.Name, &mr.Active, &applied, &mr.Created, &checksum, &progress); err != nil {
 			return fmt.Errorf("could not scan migration: %s", err)
 		}
 
-		if i < len(migrations) {
-			// update the migration at position i with information from the database
-			if migrations[i].Revision == mr.Revision {
-				migrations[i].Active = mr.Active
-				migrations[i].Applied = mr.Applied
-				migrations[i].Created = mr.Created
-				migrations[i].dbsync = true
-			} else {
-				return fmt.Errorf("unknown revision %d %q in database does not match local revision %d %q", mr.Revision, mr.Name, migrations[i].Revision, migrations[i].Name)
+		j, ok := local[mr.Revision]
+		if !ok {
+			// revisions that were squashed into a local baseline are no longer tracked
+			if k := sort.Search(len(mg.migrations), func(k int) bool { return mg.migrations[k].Revision > mr.Revision }); k < len(mg.migrations) && mg.migrations[k].squashed {
+				if mr.Active && mr.Revision > absorbed[k] {
+					absorbed[k] = mr.Revision
+				}
+				continue
 			}
 
-		} else {
 			// the database has a migration we're unaware of, which is bad
 			return fmt.Errorf("unknown revision %d %q stored in the database but not locally", mr.Revision, mr.Name)
 		}
 
-		i++ // keep track of which migrations we have synchronized
+		// update the local migration with information from the database
+		mg.migrations[j].Active = mr.Active
+		mg.migrations[j].Applied = applied.Time
+		mg.migrations[j].Created = mr.Created
+		mg.migrations[j].checksum = checksum.String
+		mg.migrations[j].progress = int(progress.Int64)
+		mg.migrations[j].dbsync = true
+
+		if mg.migrations[j].squashed && mr.Name != mg.migrations[j].Name {
+			adopted = append(adopted, j)
+		}
 	}
 
 	if err = rows.Err(); err != nil {
 		return fmt.Errorf("error while reading migrations: %s", err)
 	}
+	rows.Close()
+
+	// The baseline is missing from the database or has not been applied but revisions it
+	// replaced were applied
+	for j := range mg.migrations {
+		if current, ok := absorbed[j]; ok && !mg.migrations[j].Active {
+			return errSquashed(current, mg.migrations[j].Revision)
+		}
+	}
 
-	// Check if we need to insert migrations into the database
-	if i < len(migrations) {
-		var stmt *sql.Stmt
-		if stmt, err = tx.Prepare("INSERT INTO migrations (revision, name, created) VALUES ($1, $2, $3)"); err != nil {
-			return fmt.Errorf("could not prepare migrations insert statement: %s", err)
+	// A baseline that was applied as the migration it replaced takes over its row
+	for _, j := range adopted {
+		mg.migrations[j].checksum = ""
+		if mg.migrations[j].Active {
+			mg.migrations[j].checksum = mg.migrations[j].Checksum()
 		}
-		for j := i; j < len(migrations); j++ {
-			migrations[j].Created = time.Now().UTC()
-			if _, err = stmt.Exec(migrations[j].Revision, migrations[j].Name, migrations[j].Created); err != nil {
-				return fmt.Errorf("could not insert revision %d %q", migrations[j].Revision, migrations[j].Name)
+
+		if _, err = tx.ExecContext(ctx, mg.rebind("UPDATE migrations SET name=$1, checksum=$2 WHERE revision=$3"), mg.migrations[j].Name, nullString(mg.migrations[j].checksum), mg.migrations[j].Revision); err != nil {
+			return fmt.Errorf("could not adopt baseline revision %d: %s", mg.migrations[j].Revision, err)
+		}
+	}
+
+	// Migrations applied before checksums were stored are trusted as they are now;
+	// record their checksum so that any future edits are detected as drift.
+	for j := 1; j < len(mg.migrations); j++ {
+		if mg.migrations[j].dbsync && mg.migrations[j].Active && mg.migrations[j].checksum == "" && !mg.migrations[j].IsGo() {
+			mg.migrations[j].checksum = mg.migrations[j].Checksum()
+			if _, err = tx.ExecContext(ctx, mg.rebind("UPDATE migrations SET checksum=$1 WHERE revision=$2"), mg.migrations[j].checksum, mg.migrations[j].Revision); err != nil {
+				return fmt.Errorf("could not record checksum of revision %d: %s", mg.migrations[j].Revision, err)
 			}
-			migrations[j].dbsync = true
 		}
 	}
 
-	return nil
+	// Insert the migrations that are not yet in the database
+	var stmt *sql.Stmt
+	for j := range mg.migrations {
+		if mg.migrations[j].dbsync {
+			continue
+		}
+
+		if stmt == nil {
+			if stmt, err = tx.PrepareContext(ctx, mg.rebind("INSERT INTO migrations (revision, name, created) VALUES ($1, $2, $3)")); err != nil {
+				return fmt.Errorf("could not prepare migrations insert statement: %s", err)
+			}
+			defer stmt.Close()
+		}
+
+		mg.migrations[j].Created = time.Now().UTC()
+		if _, err = stmt.ExecContext(ctx, mg.migrations[j].Revision, mg.migrations[j].Name, mg.migrations[j].Created); err != nil {
+			return fmt.Errorf("could not insert revision %d %q", mg.migrations[j].Revision, mg.migrations[j].Name)
+		}
+		mg.migrations[j].dbsync = true
+	}
+
+	if err = mg.checkOrder(); err != nil {
+		return err
+	}
+
+	return mg.refreshRepeatables(ctx, tx)
+}
+
+// Returns an error if there are migrations that have not been applied but have an
+// earlier revision than the latest applied migration, unless the migrator allows out of
+// order migrations.
+func (mg *Migrator) checkOrder() error {
+	var latest int
+	for j := len(mg.migrations) - 1; j > 0; j-- {
+		if mg.migrations[j].Active {
+			latest = j
+			break
+		}
+	}
+
+	var pending []string
+	for j := 1; j < latest; j++ {
+		if !mg.migrations[j].Active {
+			pending = append(pending, fmt.Sprintf("%d %q", mg.migrations[j].Revision, mg.migrations[j].Name))
+		}
+	}
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	if mg.options().OutOfOrder {
+		mg.logger.Info("applying %d migration(s) out of order before applied revision %d: %s", len(pending), mg.migrations[latest].Revision, strings.Join(pending, ", "))
+		return nil
+	}
+	return fmt.Errorf("revision(s) %s have not been applied but are older than applied revision %d %q: renumber them or allow out of order migrations", strings.Join(pending, ", "), mg.migrations[latest].Revision, mg.migrations[latest].Name)
+}
+
+// Returned when the database has been partially migrated through revisions that have
+// since been squashed into a baseline, so its state cannot be represented locally.
+func errSquashed(current, baseline int64) error {
+	return fmt.Errorf("database is at revision %d which was squashed into baseline revision %d: migrate to revision %d with a version of catena from before the squash", current, baseline, baseline)
 }
 
 var sqltempl = template.Must(template.New("").Parse(`-- Revision {{ .Revision }} generated on {{ .Timestamp }}
@@ -212,20 +455,50 @@ var sqltempl = template.Must(template.New("").Parse(`-- Revision {{ .Revision }}
 -- insert down migration sql here
 `))
 
-// New creates a new migration file from a template for the next revision and checks to
-// make sure that it is valid. Specify the migrations directory for verification.
+// The layout of timestamp revisions, e.g. 20210314150926
+const timestampLayout = "20060102150405"
+
+// Returns true if the revision is a timestamp rather than a sequential revision.
+func isTimestamp(r int64) bool {
+	_, err := time.Parse(timestampLayout, strconv.FormatInt(r, 10))
+	return err == nil
+}
+
+// New creates a new migration file for the next revision of the default migrator.
 func New(name, dir string) (path string, err error) {
+	return std.New(name, dir)
+}
+
+// New creates a new migration file from a template for the next revision and checks to
+// make sure that it is valid. Specify the migrations directory for verification. The
+// revision is the current UTC timestamp if the migrator uses timestamp revisions or the latest
+// revision is already a timestamp, otherwise it is the next sequential revision.
+func (mg *Migrator) New(name, dir string) (path string, err error) {
+	mg.mu.Lock()
+	defer mg.mu.Unlock()
+
 	if name == "" {
 		name = fmt.Sprintf("auto_%s", time.Now().Format("200601021504"))
 	}
 
-	r := migrations[len(migrations)-1].Revision + 1
+	r := mg.migrations[len(mg.migrations)-1].Revision + 1
+	if mg.options().TimestampRevisions || isTimestamp(r-1) {
+		var ts int64
+		if ts, err = strconv.ParseInt(time.Now().UTC().Format(timestampLayout), 10, 64); err != nil {
+			return "", fmt.Errorf("could not create timestamp revision: %s", err)
+		}
+
+		// revisions must increase even if migrations are created within the same second
+		if ts > r {
+			r = ts
+		}
+	}
 
 	var matches []string
 	if matches, err = filepath.Glob(filepath.Join(dir, fmt.Sprintf("%04d_*.sql", r))); err != nil {
 		return "", fmt.Errorf("could not check for duplicate revisions: %s", err)
 	} else if len(matches) > 0 {
-		return "", fmt.Errorf("a migration with revision %d already exists: %s (did you run go generate?)", r, matches[0])
+		return "", fmt.Errorf("a migration with revision %d already exists: %s (did you rebuild catena?)", r, matches[0])
 	}
 
 	name = strings.Replace(name, " ", "_", -1)
@@ -255,82 +528,290 @@ func New(name, dir string) (path string, err error) {
 
 // Migration combines the information about the state of the database and how it has
 // been migrated from the migrations table alongside the migration code stored in SQL
-// files and compiled into the binary using go generate.
+// files and embedded into the binary.
 type Migration struct {
-	Revision int64     // the unique id of the migration, prefix from the migration file
-	Name     string    // the human readable name of the migration, suffix of migration file
-	Active   bool      // if the migration has been applied or not
-	Applied  time.Time // the timestamp the migration was applied
-	Created  time.Time // the timestamp the migration was created in the database
-	filename string    // the filename of the associated migration file
-	up       string    // the sql query to apply the migration (read from -- migrate: up)
-	down     string    // the sql query to rollback the migration (read from -- migrate: down)
-	dbsync   bool      // if the migration has been synchronized to the database
+	Revision   int64                    // the unique id of the migration, prefix from the migration file
+	Name       string                   // the human readable name of the migration, suffix of migration file
+	Active     bool                     // if the migration has been applied or not
+	Applied    time.Time                // the timestamp the migration was applied
+	Created    time.Time                // the timestamp the migration was created in the database
+	filename   string                   // the filename of the associated migration file
+	up         []statement              // the sql statements to apply the migration (read from -- migrate: up)
+	down       []statement              // the sql statements to rollback the migration (read from -- migrate: down)
+	dialects   map[string]*section      // the dialect specific statements (read from -- migrate: up dialect)
+	upFn       MigrationFunc            // the go function to apply the migration (go migrations only)
+	downFn     MigrationFunc            // the go function to rollback the migration (go migrations only)
+	notx       bool                     // if the migration must be run outside of a transaction
+	squashed   bool                     // if the migration is a baseline that replaces all earlier revisions
+	repeatable bool                     // if the migration is re-applied whenever its checksum changes (R__name.sql)
+	checksum   string                   // the checksum stored in the database when the migration was applied
+	limits     map[string]time.Duration // the lock and statement timeouts (read from -- migrate: lock_timeout=5s)
+	progress   int                      // the statements of a failed non-transactional migration that completed
+	dbsync     bool                     // if the migration has been synchronized to the database
+	mg         *Migrator                // the migrator that registered the migration
 }
 
 // Up applies the migration to the database.
 func (m *Migration) Up(conn *sql.DB) (err error) {
+	mg := m.migrator()
+	mg.mu.RLock()
+	defer mg.mu.RUnlock()
+
+	ctx := context.Background()
+	if m.notx {
+		return withSession(ctx, conn, m.upConn)
+	}
+
 	var tx *sql.Tx
-	if tx, err = conn.Begin(); err != nil {
+	if tx, err = conn.BeginTx(ctx, nil); err != nil {
 		return fmt.Errorf("could not begin transaction to apply revision %d: %s", m.Revision, err)
 	}
 	defer tx.Rollback()
 
-	if err = m.upTx(tx); err != nil {
+	if err = m.upTx(ctx, tx); err != nil {
 		return err
 	}
 
 	return tx.Commit()
 }
 
-func (m *Migration) upTx(tx *sql.Tx) (err error) {
-	if _, err = tx.Exec(m.up); err != nil {
-		return fmt.Errorf("could not exec apply revision %d: %s", m.Revision, err)
+// Apply the migration inside of the transaction. Errors are wrapped with the migration
+// here, and only here, whether the migration is run by Migrate or by Up.
+func (m *Migration) upTx(ctx context.Context, tx *sql.Tx) (err error) {
+	defer m.wrapError(Up, &err)
+
+	if err = m.withTimeouts(ctx, tx, true, func() error {
+		if m.upFn != nil {
+			if err := m.upFn(ctx, tx); err != nil {
+				return fmt.Errorf("%s: %w", m.filename, err)
+			}
+			return nil
+		}
+		return m.exec(ctx, tx, m.statements(Up))
+	}); err != nil {
+		return err
+	}
+
+	return m.markApplied(ctx, tx)
+}
+
+// Record that the migration has been applied in the migrations table.
+func (m *Migration) markApplied(ctx context.Context, tx *sql.Tx) (err error) {
+	if m.repeatable {
+		return m.markRepeatable(ctx, tx)
 	}
 
 	// If this is migration 0, we have a special sql query so we don't keep updating the applied timestamp
-	sql := "UPDATE migrations SET active=$1, applied=$2 WHERE revision=$3"
+	sql := "UPDATE migrations SET active=$1, applied=$2, checksum=$3 WHERE revision=$4"
+	args := []interface{}{true, time.Now().UTC(), nullString(m.Checksum()), m.Revision}
 	if m.Revision == 0 {
-		sql = "UPDATE migrations SET active=$1, applied=$2 WHERE revision=$3 AND active='f' AND applied is NULL"
+		sql = "UPDATE migrations SET active=$1, applied=$2, checksum=$3 WHERE revision=$4 AND active=$5 AND applied is NULL"
+		args = append(args, false)
 	}
 
-	if _, err = tx.Exec(sql, true, time.Now().UTC(), m.Revision); err != nil {
+	if _, err = tx.ExecContext(ctx, m.migrator().rebind(sql), args...); err != nil {
 		return fmt.Errorf("could not update migration status: %s", err)
 	}
 
+	m.checksum = m.Checksum()
+	return nil
+}
+
+// Execute the up statements of a non-transactional migration, resuming a previous
+// failed attempt, then record that the migration was applied.
+func (m *Migration) upConn(ctx context.Context, conn *sql.Conn) (err error) {
+	defer m.wrapError(Up, &err)
+
+	if err = m.withTimeouts(ctx, conn, false, func() error {
+		return m.resume(ctx, conn, m.statements(Up))
+	}); err != nil {
+		return err
+	}
+
+	if _, err = conn.ExecContext(ctx, m.migrator().rebind("UPDATE migrations SET active=$1, applied=$2, checksum=$3, progress=NULL WHERE revision=$4"), true, time.Now().UTC(), m.Checksum(), m.Revision); err != nil {
+		return fmt.Errorf("could not update migration status: %s", err)
+	}
+
+	m.checksum = m.Checksum()
+	m.progress = 0
 	return nil
 }
 
 // Down rolls back the migration from the database.
 func (m *Migration) Down(conn *sql.DB) (err error) {
+	mg := m.migrator()
+	mg.mu.RLock()
+	defer mg.mu.RUnlock()
+
+	ctx := context.Background()
+	if m.notx {
+		return withSession(ctx, conn, m.downConn)
+	}
+
 	var tx *sql.Tx
-	if tx, err = conn.Begin(); err != nil {
+	if tx, err = conn.BeginTx(ctx, nil); err != nil {
 		return fmt.Errorf("could not begin transaction to rollback revision %d: %s", m.Revision, err)
 	}
 	defer tx.Rollback()
 
-	if err = m.downTx(tx); err != nil {
+	if err = m.downTx(ctx, tx); err != nil {
 		return err
 	}
 
 	return tx.Commit()
 }
 
-func (m *Migration) downTx(tx *sql.Tx) (err error) {
-	if _, err = tx.Exec(m.down); err != nil {
-		return fmt.Errorf("could not exec rollback revision %d: %s", m.Revision, err)
+// Roll back the migration inside of the transaction, see upTx.
+func (m *Migration) downTx(ctx context.Context, tx *sql.Tx) (err error) {
+	defer m.wrapError(Down, &err)
+
+	if err = m.withTimeouts(ctx, tx, true, func() error {
+		if m.downFn != nil {
+			if err := m.downFn(ctx, tx); err != nil {
+				return fmt.Errorf("%s: %w", m.filename, err)
+			}
+			return nil
+		}
+		return m.exec(ctx, tx, m.statements(Down))
+	}); err != nil {
+		return err
 	}
 
-	if _, err = tx.Exec("UPDATE migrations SET active=$1, applied=NULL WHERE revision=$3", false, m.Revision); err != nil {
+	if _, err = tx.ExecContext(ctx, m.migrator().rebind("UPDATE migrations SET active=$1, applied=NULL, checksum=NULL WHERE revision=$2"), false, m.Revision); err != nil {
 		return fmt.Errorf("could not update migration status: %s", err)
 	}
 
+	if err = m.rollbackSquashed(ctx, tx); err != nil {
+		return err
+	}
+
+	m.checksum = ""
 	return nil
 }
 
+// Execute the down statements of a non-transactional migration, resuming a previous
+// failed attempt, then record that the migration was rolled back.
+func (m *Migration) downConn(ctx context.Context, conn *sql.Conn) (err error) {
+	defer m.wrapError(Down, &err)
+
+	if err = m.withTimeouts(ctx, conn, false, func() error {
+		return m.resume(ctx, conn, m.statements(Down))
+	}); err != nil {
+		return err
+	}
+
+	if _, err = conn.ExecContext(ctx, m.migrator().rebind("UPDATE migrations SET active=$1, applied=NULL, checksum=NULL, progress=NULL WHERE revision=$2"), false, m.Revision); err != nil {
+		return fmt.Errorf("could not update migration status: %s", err)
+	}
+
+	if err = m.rollbackSquashed(ctx, conn); err != nil {
+		return err
+	}
+
+	m.checksum = ""
+	m.progress = 0
+	return nil
+}
+
+// Rolling back a baseline also rolls back the revisions that it replaced, which may
+// still be in the database, so that the database is not left inside the squashed range.
+// The caller must hold the migrator's lock.
+func (m *Migration) rollbackSquashed(ctx context.Context, q Querier) (err error) {
+	if !m.squashed {
+		return nil
+	}
+
+	var prev int64
+	if i := m.predecessors(); i > 0 {
+		prev = m.migrator().migrations[i-1].Revision
+	}
+
+	if _, err = q.ExecContext(ctx, m.migrator().rebind("UPDATE migrations SET active=$1, applied=NULL, checksum=NULL WHERE revision > $2 AND revision < $3"), false, prev, m.Revision); err != nil {
+		return fmt.Errorf("could not rollback squashed revisions: %s", err)
+	}
+	return nil
+}
+
+// Prefix an error applying or rolling back the migration with the migration.
+func (m *Migration) wrapError(d Direction, err *error) {
+	if *err == nil {
+		return
+	}
+
+	if d == Down {
+		*err = fmt.Errorf("could not rollback %s: %w", m.ref(), *err)
+		return
+	}
+	*err = fmt.Errorf("could not apply %s: %w", m.ref(), *err)
+}
+
+// Execute the statements in order, reporting the file and line of a failed statement.
+func (m *Migration) exec(ctx context.Context, tx *sql.Tx, stmts []statement) (err error) {
+	for _, stmt := range stmts {
+		if _, err = tx.ExecContext(ctx, m.sql(stmt)); err != nil {
+			return fmt.Errorf("%s:%d: %w", m.filename, stmt.errorLine(err), err)
+		}
+	}
+	return nil
+}
+
+// Execute the statements in order outside of a transaction, skipping the statements
+// that completed during a previous failed attempt. Progress is recorded in the database
+// after each statement so that if a statement fails, the next attempt resumes with it.
+func (m *Migration) resume(ctx context.Context, conn *sql.Conn, stmts []statement) (err error) {
+	if m.progress > len(stmts) {
+		return fmt.Errorf("%s: recorded progress of %d statements but only %d remain in the file", m.filename, m.progress, len(stmts))
+	}
+
+	if m.progress > 0 {
+		m.migrator().logger.Info("resuming revision %d at statement %d of %d", m.Revision, m.progress+1, len(stmts))
+	}
+
+	for i := m.progress; i < len(stmts); i++ {
+		if _, err = conn.ExecContext(ctx, m.sql(stmts[i])); err != nil {
+			return fmt.Errorf("%s:%d: %w", m.filename, stmts[i].errorLine(err), err)
+		}
+
+		m.progress = i + 1
+		if _, err = conn.ExecContext(ctx, m.migrator().rebind("UPDATE migrations SET progress=$1 WHERE revision=$2"), m.progress, m.Revision); err != nil {
+			return fmt.Errorf("could not record progress: %s", err)
+		}
+	}
+	return nil
+}
+
+// Returns the SQL of a statement of the migration. The statements of the migrations
+// schema create the bookkeeping tables, so they are renamed for the migrator's table.
+func (m *Migration) sql(stmt statement) string {
+	if m.Revision == 0 && !m.repeatable {
+		return m.migrator().renameTables(stmt.lexer())
+	}
+	return stmt.sql
+}
+
+// Run a function that requires a dedicated connection to the database, e.g. to execute
+// statements that cannot be run inside of a transaction.
+func withSession(ctx context.Context, conn *sql.DB, fn func(context.Context, *sql.Conn) error) (err error) {
+	var session *sql.Conn
+	if session, err = conn.Conn(ctx); err != nil {
+		return fmt.Errorf("could not connect to database: %s", err)
+	}
+	defer session.Close()
+
+	return fn(ctx, session)
+}
+
 func (m *Migration) String() string {
+	mg := m.migrator()
+	mg.mu.RLock()
+	defer mg.mu.RUnlock()
+
 	builder := &strings.Builder{}
-	fmt.Fprintf(builder, "revision: %d\nname: %q\n", m.Revision, m.Name)
+	if m.repeatable {
+		fmt.Fprintf(builder, "repeatable: true\nname: %q\n", m.Name)
+	} else {
+		fmt.Fprintf(builder, "revision: %d\nname: %q\n", m.Revision, m.Name)
+	}
 	if m.dbsync {
 		fmt.Fprintf(
 			builder,
@@ -342,18 +823,39 @@ func (m *Migration) String() string {
 	}
 
 	fmt.Fprintf(builder, "filename: %s\n", m.filename)
-	fmt.Fprintf(builder, "predecessors: %d\n", m.Predecessors())
-	fmt.Fprintf(builder, "successors: %d\n", m.Successors())
+	if m.IsGo() {
+		fmt.Fprintln(builder, "type: go")
+	} else {
+		fmt.Fprintln(builder, "type: sql")
+		fmt.Fprintf(builder, "checksum: %s\n", m.Checksum())
+	}
+	if m.squashed {
+		fmt.Fprintln(builder, "squashed: true")
+	}
+	if m.notx {
+		fmt.Fprintln(builder, "transaction: false")
+		if m.progress > 0 {
+			fmt.Fprintf(builder, "progress: %d statements completed\n", m.progress)
+		}
+	}
+	if lock, statement := m.timeouts(); lock > 0 || statement > 0 {
+		fmt.Fprintf(builder, "lock_timeout: %s\nstatement_timeout: %s\n", formatTimeout(lock), formatTimeout(statement))
+	}
+	if m.Modified() {
+		fmt.Fprintf(builder, "modified: true (applied checksum %s)\n", m.checksum)
+	}
+	fmt.Fprintf(builder, "predecessors: %d\n", m.predecessors())
+	fmt.Fprintf(builder, "successors: %d\n", m.successors())
 
 	if debug {
-		if m.up != "" {
+		if m.UpSQL() != "" {
 			fmt.Fprint(builder, "\nup\n--\n")
-			fmt.Fprintln(builder, m.up)
+			fmt.Fprintln(builder, m.UpSQL())
 		}
 
-		if m.down != "" {
+		if m.DownSQL() != "" {
 			fmt.Fprint(builder, "\ndown\n----\n")
-			fmt.Fprintln(builder, m.down)
+			fmt.Fprintln(builder, m.DownSQL())
 		}
 	}
 
@@ -365,14 +867,98 @@ func (m *Migration) Filename() string {
 	return m.filename
 }
 
-// UpSQL returns the query that will be executed when Up() is run
-func (m *Migration) UpSQL() string {
+// Returns the statements executed in the specified direction by the current dialect;
+// a dialect specific section of the migration file replaces the generic section.
+func (m *Migration) statements(d Direction) []statement {
+	return m.statementsFor(m.migrator().dialect.Name(), d)
+}
+
+// Returns the statements executed in the specified direction by the named dialect.
+func (m *Migration) statementsFor(name string, d Direction) []statement {
+	if s, ok := m.dialects[name]; ok {
+		if d == Up && s.up != nil {
+			return s.up
+		}
+		if d == Down && s.down != nil {
+			return s.down
+		}
+	}
+
+	if d == Down {
+		return m.down
+	}
 	return m.up
 }
 
-// DownSQL returns the query that will be executed when Down() is run
+// UpSQL returns the statements that will be executed when Up() is run
+func (m *Migration) UpSQL() string {
+	return joinStatements(m.statements(Up))
+}
+
+// DownSQL returns the statements that will be executed when Down() is run
 func (m *Migration) DownSQL() string {
-	return m.down
+	return joinStatements(m.statements(Down))
+}
+
+// Checksum returns the hex encoded SHA-256 hash of the up and down SQL of the migration
+// that is executed by the current dialect. Whitespace and comments between tokens are
+// normalized before hashing so that reformatting a migration file does not change its
+// checksum, but any change to the SQL itself does, including to the whitespace inside of
+// string literals and function bodies. Go migrations have no SQL and return an empty
+// checksum.
+func (m *Migration) Checksum() string {
+	if m.IsGo() {
+		return ""
+	}
+
+	hash := sha256.New()
+	hash.Write([]byte(normalizeStatements(m.statements(Up))))
+	hash.Write([]byte{0})
+	hash.Write([]byte(normalizeStatements(m.statements(Down))))
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Modified returns true if the migration has been applied to the database but its
+// SQL no longer matches the checksum that was stored when it was applied. Migration 0
+// is never considered modified since it is run on every refresh, nor are repeatable
+// migrations since they are re-applied when they change.
+func (m *Migration) Modified() bool {
+	if !m.dbsync || !m.Active || m.Revision == 0 || m.repeatable || m.checksum == "" {
+		return false
+	}
+	return m.checksum != m.Checksum()
+}
+
+// IsGo returns true if the migration is implemented by Go functions registered with
+// RegisterGo rather than by a SQL file.
+func (m *Migration) IsGo() bool {
+	return m.upFn != nil
+}
+
+// Squashed returns true if the migration is a baseline that replaces all of the earlier
+// revisions, which is specified with the "-- migrate: squashed" directive.
+func (m *Migration) Squashed() bool {
+	return m.squashed
+}
+
+// Repeatable returns true if the migration is a repeatable migration, which is
+// identified by its name rather than a revision.
+func (m *Migration) Repeatable() bool {
+	return m.repeatable
+}
+
+// Returns a reference to the migration for error messages.
+func (m *Migration) ref() string {
+	if m.repeatable {
+		return fmt.Sprintf("repeatable migration %q", m.Name)
+	}
+	return fmt.Sprintf("revision %d", m.Revision)
+}
+
+// Transactional returns false if the migration must be run outside of a transaction,
+// which is specified with the "-- migrate: no-transaction" directive.
+func (m *Migration) Transactional() bool {
+	return !m.notx
 }
 
 // DBSync returns true if the migration is in the database.
@@ -381,8 +967,15 @@ func (m *Migration) DBSync() bool {
 }
 
 // Predecessors returns the number of migrations before this migration.
-func (m *Migration) Predecessors() (n int) {
-	for _, o := range migrations {
+func (m *Migration) Predecessors() int {
+	mg := m.migrator()
+	mg.mu.RLock()
+	defer mg.mu.RUnlock()
+	return m.predecessors()
+}
+
+func (m *Migration) predecessors() (n int) {
+	for _, o := range m.migrator().migrations {
 		if m.Revision == o.Revision {
 			break
 		}
@@ -392,7 +985,15 @@ func (m *Migration) Predecessors() (n int) {
 }
 
 // Successors returns the number of migrations after this migration.
-func (m *Migration) Successors() (n int) {
+func (m *Migration) Successors() int {
+	mg := m.migrator()
+	mg.mu.RLock()
+	defer mg.mu.RUnlock()
+	return m.successors()
+}
+
+func (m *Migration) successors() int {
+	migrations := m.migrator().migrations
 	i := sort.Search(len(migrations), func(i int) bool {
 		return m.Revision <= migrations[i].Revision
 	})
@@ -406,83 +1007,6 @@ func (m *Migration) Successors() (n int) {
 	panic(fmt.Errorf("revisions %d was not in the package migrations", m.Revision))
 }
 
-// Parse a migration file into an unsynchronized migration struct. This function is only
-// used by go generate and though it can help users diagnose migration parsing issues,
-// is generally not useful outside of the package.
-func Parse(filename string) (m *Migration, err error) {
-	m = &Migration{
-		filename: filename,
-		dbsync:   false,
-	}
-
-	if !strings.HasSuffix(filename, ".sql") {
-		return nil, errors.New("migration filenames must end in .sql extension")
-	}
-
-	parts := strings.Split(strings.TrimSuffix(filename, ".sql"), "_")
-	if len(parts) < 2 {
-		return nil, errors.New("must format migration filenames as XXXX_description.sql")
-	}
-
-	if m.Revision, err = strconv.ParseInt(parts[0], 10, 64); err != nil {
-		return nil, fmt.Errorf("could not parse revision from %q: %s", filename, err)
-	}
-
-	m.Name = strings.Join(parts[1:], " ")
-
-	upb := &strings.Builder{}
-	dnb := &strings.Builder{}
-
-	var (
-		f       *os.File
-		current *strings.Builder
-	)
-
-	if f, err = os.Open(filename); err != nil {
-		return nil, fmt.Errorf("could not open %q: %s", filename, err)
-	}
-	defer f.Close()
-
-	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line == "" {
-			continue
-		}
-
-		if strings.HasPrefix(line, "--") {
-			line := strings.ToLower(strings.TrimLeft(line, "- \t"))
-			if strings.HasPrefix(line, "migrate:") {
-				line := strings.TrimLeft(line, "migrate: \t")
-				if line == "up" {
-					current = upb
-				} else if line == "down" {
-					current = dnb
-				} else {
-					return nil, fmt.Errorf("%q is not a valid migrate directive", line)
-				}
-			}
-			continue
-		}
-
-		if current == nil {
-			return nil, errors.New("did not encounter a 'migrate:' directive")
-		}
-
-		current.WriteString(line + " ")
-	}
-
-	if err = scanner.Err(); err != nil {
-		return nil, err
-	}
-
-	m.up = upb.String()
-	m.down = dnb.String()
-
-	// append the migration to the migrations
-	return m, nil
-}
-
 // ByRevision implements sort.Interface for []Migration based on the Revision field.
 type ByRevision []Migration
 
@@ -490,31 +1014,7 @@ func (a ByRevision) Len() int           { return len(a) }
 func (a ByRevision) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 func (a ByRevision) Less(i, j int) bool { return a[i].Revision < a[j].Revision }
 
-// Internal API
-
-// Add a migration to the local migrations slice, panic if things go wrong.
-func local(revision int64, name, filename string, up []byte, down []byte) {
-	m := &Migration{
-		Revision: revision,
-		Name:     name,
-		filename: filename,
-		dbsync:   false,
-	}
-
-	if len(up) > 0 {
-		m.up = string(up)
-	}
-
-	if len(down) > 0 {
-		m.down = string(down)
-	}
-
-	if len(migrations) > 0 {
-		prev := migrations[len(migrations)-1]
-		if m.Revision <= prev.Revision {
-			panic(fmt.Errorf("cannot insert revision %d after revision %d", m.Revision, prev.Revision))
-		}
-	}
-
-	migrations = append(migrations, *m)
+// Returns a NULL string for the database if s is empty.
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
 }
@@ -1,16 +1,25 @@
 package migrations_test
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"sync"
 	"testing"
+	"testing/fstest"
+	"time"
 
 	. "github.com/bbengfort/catena/migrations"
 	"github.com/stretchr/testify/require"
 
-	// use postgres for the test database
-	_ "github.com/lib/pq"
+	// use postgres for the test database and sqlite for local tests
+	"github.com/lib/pq"
+	_ "modernc.org/sqlite"
 )
 
 // Test the migrations package and code -- does not run database commands.
@@ -18,7 +27,7 @@ func TestMigrations(t *testing.T) {
 	// Must be same number of migrations as .sql files
 	names, err := filepath.Glob("*.sql")
 	require.NoError(t, err)
-	require.Equal(t, len(names), Num(), "number of expected migrations doesn't match, have you run go generate?")
+	require.Equal(t, len(names), Num(), "number of expected migrations doesn't match the embedded files")
 
 	// Migration 0 should be the migration schema migration (it's special)
 	m, err := Revision(0, nil)
@@ -30,6 +39,422 @@ func TestMigrations(t *testing.T) {
 	require.Error(t, err)
 }
 
+// Test that migrations from other sources cannot collide with registered revisions.
+func TestRegister(t *testing.T) {
+	n := Num()
+
+	// Revision 0 is always registered by the package
+	fsys := fstest.MapFS{
+		"0000_duplicate.sql":      {Data: []byte("-- migrate: up\nSELECT 1;")},
+		"1000_not_registered.sql": {Data: []byte("-- migrate: up\nSELECT 1;")},
+	}
+	require.EqualError(t, Register(fsys), "cannot register 0000_duplicate.sql: revision 0 is already registered by 0000_migrations_schema.sql")
+	require.Equal(t, n, Num(), "migrations were registered from a source with an error")
+
+	// A source with a migration that cannot be parsed is not registered
+	require.Error(t, Register(os.DirFS("testdata")))
+	require.Equal(t, n, Num(), "migrations were registered from a source with an error")
+}
+
+// Test that go migrations are validated before they are registered.
+func TestRegisterGo(t *testing.T) {
+	n := Num()
+	noop := func(ctx context.Context, tx *sql.Tx) error { return nil }
+
+	require.EqualError(t, RegisterGo(1000, "no up function", nil, noop), "cannot register revision 1000: go migrations require an up function")
+	require.EqualError(t, RegisterGo(0, "duplicate", noop, noop), `cannot register revision 0 "duplicate": revision is already registered by 0000_migrations_schema.sql`)
+	require.Equal(t, n, Num(), "invalid go migrations were registered")
+}
+
+// Test that go migrations are applied and rolled back in order with the SQL migrations.
+func TestGoMigration(t *testing.T) {
+	SetDialect(SQLite)
+	defer SetDialect(Postgres)
+
+	conn, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "catena.db"))
+	require.NoError(t, err, "could not open database")
+	defer conn.Close()
+
+	Isolate(t)
+	require.NoError(t, Register(fstest.MapFS{
+		"0001_notes.sql": {Data: []byte("-- migrate: up\nCREATE TABLE notes (id integer PRIMARY KEY, body text);\nINSERT INTO notes (id) VALUES (1), (2);\n-- migrate: down\nDROP TABLE notes;")},
+	}))
+
+	backfill := func(ctx context.Context, tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, "UPDATE notes SET body='note ' || id")
+		return err
+	}
+	reset := func(ctx context.Context, tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, "UPDATE notes SET body=NULL")
+		return err
+	}
+	require.NoError(t, RegisterGo(2, "backfill_body", backfill, reset))
+
+	n, err := Migrate(-1, conn)
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+
+	var body string
+	require.NoError(t, conn.QueryRow("SELECT body FROM notes WHERE id=2").Scan(&body))
+	require.Equal(t, "note 2", body)
+
+	var (
+		active   bool
+		checksum sql.NullString
+	)
+	require.NoError(t, conn.QueryRow("SELECT active, checksum FROM migrations WHERE revision=2 AND name='backfill_body'").Scan(&active, &checksum))
+	require.True(t, active)
+	require.False(t, checksum.Valid, "go migrations have no checksum")
+
+	m, err := Revision(2, conn)
+	require.NoError(t, err)
+	require.True(t, m.IsGo())
+	require.Contains(t, m.String(), "filename: "+m.Filename()+"\ntype: go\n")
+	require.Equal(t, "migrations_test.go", filepath.Base(m.Filename()))
+
+	n, err = Migrate(1, conn)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+
+	var cleared sql.NullString
+	require.NoError(t, conn.QueryRow("SELECT body FROM notes WHERE id=2").Scan(&cleared))
+	require.False(t, cleared.Valid)
+
+	require.NoError(t, conn.QueryRow("SELECT active, checksum FROM migrations WHERE revision=2").Scan(&active, &checksum))
+	require.False(t, active)
+	require.False(t, checksum.Valid)
+
+	records, err := History(conn, 1)
+	require.NoError(t, err)
+	require.Equal(t, "backfill_body", records[0].Name)
+	require.Equal(t, Down, records[0].Direction)
+}
+
+// Test that migration checksums are stable and unsynchronized migrations are unmodified.
+func TestChecksum(t *testing.T) {
+	m, err := Revision(0, nil)
+	require.NoError(t, err)
+
+	checksum := m.Checksum()
+	require.Len(t, checksum, 64)
+	require.Equal(t, checksum, m.Checksum(), "checksum is not deterministic")
+	require.False(t, m.Modified(), "migration is modified without being synchronized")
+
+	// only whitespace and comments between tokens are ignored, not inside of literals
+	checksums := func(sql ...string) (checksums []string) {
+		Isolate(t)
+		fsys := fstest.MapFS{}
+		for i, src := range sql {
+			fsys[fmt.Sprintf("%04d_notes.sql", 9901+i)] = &fstest.MapFile{Data: []byte(src)}
+		}
+		require.NoError(t, Register(fsys))
+
+		for i := range sql {
+			m, err := Revision(int64(9901+i), nil)
+			require.NoError(t, err)
+			checksums = append(checksums, m.Checksum())
+		}
+		return checksums
+	}
+
+	sums := checksums(
+		"-- migrate: up\nINSERT INTO notes (body) VALUES ('a  b');\n-- migrate: down\nDELETE FROM notes;",
+		"-- migrate: up\n-- a comment\nINSERT  INTO notes\n    (body) /* values */ VALUES ('a  b');\n-- migrate: down\nDELETE FROM notes;",
+		"-- migrate: up\nINSERT INTO notes (body) VALUES ('a b');\n-- migrate: down\nDELETE FROM notes;",
+		"-- migrate: up\nCREATE FUNCTION touch() RETURNS text AS $$ SELECT 'a  b' $$ LANGUAGE sql;\n-- migrate: down\nDROP FUNCTION touch();",
+		"-- migrate: up\nCREATE FUNCTION touch() RETURNS text AS $$ SELECT 'a b' $$ LANGUAGE sql;\n-- migrate: down\nDROP FUNCTION touch();",
+	)
+	require.Equal(t, sums[0], sums[1], "whitespace and comments between tokens should be ignored")
+	require.NotEqual(t, sums[0], sums[2], "whitespace inside of a string literal is ignored")
+	require.NotEqual(t, sums[3], sums[4], "whitespace inside of a dollar-quoted body is ignored")
+}
+
+// Test the human readable step directions used in migration plans.
+func TestDirection(t *testing.T) {
+	require.Equal(t, "up", Up.String())
+	require.Equal(t, "down", Down.String())
+	require.Equal(t, "unknown", Direction(0).String())
+
+	step := Step{Direction: Down}
+	require.Equal(t, step.DownSQL(), step.SQL())
+}
+
+// Test that statements are split without mangling strings, comments or function bodies.
+func TestParse(t *testing.T) {
+	m, err := Parse(filepath.Join("testdata", "0001_statements.sql"))
+	require.NoError(t, err)
+	require.Equal(t, int64(1), m.Revision)
+	require.Equal(t, "statements", m.Name)
+
+	up := "CREATE TABLE notes (\n" +
+		"    id serial PRIMARY KEY,\n" +
+		"    -- comments inside of a statement are kept\n" +
+		"    body text NOT NULL DEFAULT '-- not a comment; not the end'\n" +
+		");\n" +
+		"CREATE FUNCTION touch() RETURNS trigger AS $$\n" +
+		"BEGIN\n" +
+		"    NEW.body := NEW.body || ';';\n" +
+		"    RETURN NEW;\n" +
+		"END;\n" +
+		"$$ LANGUAGE plpgsql;\n" +
+		"INSERT INTO notes (body) VALUES (E'it\\'s; escaped'), ('it''s; doubled');"
+	require.Equal(t, up, m.UpSQL())
+	require.Equal(t, "DROP FUNCTION touch();\nDROP TABLE notes", m.DownSQL())
+	require.True(t, m.Transactional())
+
+	// The no-transaction directive can be specified before the up section
+	m, err = Parse(filepath.Join("testdata", "0004_concurrent_index.sql"))
+	require.NoError(t, err)
+	require.False(t, m.Transactional())
+	require.Equal(t, "CREATE INDEX CONCURRENTLY IF NOT EXISTS notes_body_idx ON notes (body);", m.UpSQL())
+
+	// Parse errors should report the location of the problem in the file
+	_, err = Parse(filepath.Join("testdata", "0002_unterminated.sql"))
+	require.EqualError(t, err, "testdata/0002_unterminated.sql:2: unterminated dollar-quoted string $body$")
+
+	_, err = Parse(filepath.Join("testdata", "0003_no_directive.sql"))
+	require.EqualError(t, err, "testdata/0003_no_directive.sql:3: did not encounter a 'migrate:' directive")
+
+	// Statements without directives can be split with the same lexer
+	stmts, err := SplitStatements("-- leading comment\nINSERT INTO notes (body) VALUES ('a;b');;\nSELECT 1")
+	require.NoError(t, err)
+	require.Equal(t, []string{"INSERT INTO notes (body) VALUES ('a;b');", "SELECT 1"}, stmts)
+}
+
+// Test that destructive and locking operations are reported unless they are allowed.
+func TestLint(t *testing.T) {
+	m, err := Parse(filepath.Join("testdata", "0006_lint.sql"))
+	require.NoError(t, err)
+
+	var issues []string
+	for _, issue := range Lint(m, "edges") {
+		issues = append(issues, issue.String())
+	}
+
+	require.Equal(t, []string{
+		"testdata/0006_lint.sql:4: error: creating an index on large table edges without CONCURRENTLY blocks writes (index-concurrently)",
+		"testdata/0006_lint.sql:6: warning: creating an index on nodes without CONCURRENTLY blocks writes (index-concurrently)",
+		"testdata/0006_lint.sql:7: error: adding NOT NULL column nodes.bio without a default fails if the table has rows (not-null-no-default)",
+		"testdata/0006_lint.sql:8: error: changing the type of nodes.followers may rewrite the table while holding an exclusive lock (type-change)",
+		"testdata/0006_lint.sql:11: error: dropping column edges.weight destroys its data (drop-column)",
+		"testdata/0006_lint.sql:13: error: dropping a table destroys its data (drop-table)",
+		"testdata/0006_lint.sql:1: warning: the migration has no down statements so it cannot be rolled back (missing-down)",
+	}, issues)
+
+	m, err = Parse(filepath.Join("testdata", "0001_statements.sql"))
+	require.NoError(t, err)
+	require.Empty(t, Lint(m))
+}
+
+// Test that dialect specific sections replace the generic sections for that dialect.
+func TestDialects(t *testing.T) {
+	defer SetDialect(Postgres)
+
+	m, err := Parse(filepath.Join("testdata", "0005_dialects.sql"))
+	require.NoError(t, err)
+	require.Equal(t, "CREATE TABLE notes (id serial PRIMARY KEY, body text NOT NULL) WITHOUT OIDS;", m.UpSQL())
+	checksum := m.Checksum()
+
+	SetDialect(SQLite)
+	require.Equal(t, "CREATE TABLE notes (id integer PRIMARY KEY AUTOINCREMENT, body text NOT NULL);", m.UpSQL())
+	require.Equal(t, "DROP TABLE notes;", m.DownSQL(), "the generic down section should be used")
+	require.NotEqual(t, checksum, m.Checksum(), "checksum should be computed from the dialect's statements")
+
+	for name, expected := range map[string]Dialect{"postgresql": Postgres, "sqlite3": SQLite, "MySQL": MySQL} {
+		d, err := DialectFor(name)
+		require.NoError(t, err)
+		require.Equal(t, expected, d)
+	}
+
+	_, err = DialectFor("oracle")
+	require.EqualError(t, err, `unknown database dialect "oracle"`)
+
+	fsys := fstest.MapFS{
+		"1000_oracle.sql": {Data: []byte("-- migrate: up oracle\nSELECT 1 FROM dual;")},
+	}
+	require.EqualError(t, Register(fsys), `1000_oracle.sql:1: unknown database dialect "oracle"`)
+
+	// mysql sections are split with the lexical rules of mysql
+	path := filepath.Join(t.TempDir(), "1001_mysql.sql")
+	src := "-- migrate: up\nINSERT INTO notes (body) VALUES ('a\\');\n" +
+		"-- migrate: up mysql\nINSERT INTO notes (body) VALUES ('it\\'s; escaped', \"semi;colon\"); # a comment; with a semicolon\n" +
+		"CREATE TABLE `odd;name` (id int);\nSELECT 5--1;\n" +
+		"-- migrate: down\nDROP TABLE notes;"
+	require.NoError(t, os.WriteFile(path, []byte(src), 0644))
+
+	m, err = Parse(path)
+	require.NoError(t, err)
+	require.Equal(t, "INSERT INTO notes (body) VALUES ('a\\');", m.UpSQL(), "backslashes are not escapes in postgres strings")
+
+	SetDialect(MySQL)
+	require.Equal(t, "INSERT INTO notes (body) VALUES ('it\\'s; escaped', \"semi;colon\");\nCREATE TABLE `odd;name` (id int);\nSELECT 5--1;", m.UpSQL())
+	require.Equal(t, "DROP TABLE notes;", m.DownSQL())
+
+	// the migrations schema can be rolled back on every dialect
+	schema, err := Revision(0, nil)
+	require.NoError(t, err)
+	require.Equal(t, "DROP TABLE IF EXISTS repeatable_migrations;\nDROP TABLE IF EXISTS migrations;", schema.DownSQL())
+}
+
+// Test the migrations against a SQLite database, which does not require a server.
+func TestSQLite(t *testing.T) {
+	SetDialect(SQLite)
+	defer SetDialect(Postgres)
+
+	conn, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "catena.db"))
+	require.NoError(t, err, "could not open database")
+	defer conn.Close()
+
+	n, err := Migrate(-1, conn)
+	require.NoError(t, err)
+	require.Equal(t, Num()-1, n, "all migrations after the schema should be applied")
+
+	current, err := Current(conn)
+	require.NoError(t, err)
+	require.True(t, current.Active)
+
+	// The lock must have been released for the database to be refreshed again
+	modified, err := Verify(conn)
+	require.NoError(t, err)
+	require.Empty(t, modified)
+
+	steps, err := Plan(current.Revision, conn)
+	require.NoError(t, err)
+	require.Empty(t, steps)
+
+	var rows int
+	require.NoError(t, conn.QueryRow("SELECT count(*) FROM migrations WHERE active").Scan(&rows))
+	require.Equal(t, Num(), rows)
+}
+
+// Test that a failed non-transactional migration records the statements that completed
+// and that the next migration resumes with the statement that failed.
+func TestNoTransaction(t *testing.T) {
+	SetDialect(SQLite)
+	defer SetDialect(Postgres)
+
+	conn, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "catena.db"))
+	require.NoError(t, err, "could not open database")
+	defer conn.Close()
+
+	notes := &fstest.MapFile{Data: []byte("-- migrate: up\nCREATE TABLE notes (id integer PRIMARY KEY);\n-- migrate: down\nDROP TABLE notes;")}
+	tags := "-- migrate: no-transaction\n-- migrate: up\nCREATE TABLE tags (id integer PRIMARY KEY);\nINSERT INTO %s (id) VALUES (1);\nCREATE INDEX tags_id ON tags (id);\n-- migrate: down\nDROP TABLE tags;"
+
+	Isolate(t)
+	require.NoError(t, Register(fstest.MapFS{
+		"0001_notes.sql": notes,
+		"0002_tags.sql":  {Data: []byte(fmt.Sprintf(tags, "tag"))},
+	}))
+
+	// the transactional migration is committed before the failed statement
+	n, err := Migrate(-1, conn)
+	require.Error(t, err)
+	require.Regexp(t, `^could not apply revision 2: 0002_tags.sql:4: `, err.Error())
+	require.Equal(t, 1, n)
+
+	var progress sql.NullInt64
+	require.NoError(t, conn.QueryRow("SELECT progress FROM migrations WHERE revision=2").Scan(&progress))
+	require.Equal(t, sql.NullInt64{Int64: 1, Valid: true}, progress)
+
+	m, err := Revision(2, conn)
+	require.NoError(t, err)
+	require.False(t, m.Active)
+	require.Contains(t, m.String(), "progress: 1 statements completed\n")
+
+	// the fixed migration resumes at the insert rather than creating the table again
+	Isolate(t)
+	require.NoError(t, Register(fstest.MapFS{
+		"0001_notes.sql": notes,
+		"0002_tags.sql":  {Data: []byte(fmt.Sprintf(tags, "tags"))},
+	}))
+
+	n, err = Migrate(-1, conn)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+
+	require.NoError(t, conn.QueryRow("SELECT progress FROM migrations WHERE revision=2").Scan(&progress))
+	require.False(t, progress.Valid)
+
+	var rows int
+	require.NoError(t, conn.QueryRow("SELECT count(*) FROM tags").Scan(&rows))
+	require.Equal(t, 1, rows)
+
+	records, err := History(conn, 2)
+	require.NoError(t, err)
+	require.True(t, records[0].Success)
+	require.False(t, records[1].Success)
+	require.Equal(t, int64(2), records[1].Revision)
+}
+
+// Test that a migration waits for the migrations lock held by another process and gives
+// up after the lock wait, naming the holder of the lock.
+func TestLock(t *testing.T) {
+	ctx := context.Background()
+	conn, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "catena.db"))
+	require.NoError(t, err, "could not open database")
+	defer conn.Close()
+
+	mg, err := NewMigrator(SQLite, "")
+	require.NoError(t, err)
+
+	opts := mg.Options()
+	opts.LockWait = 600 * time.Millisecond
+	mg.SetOptions(opts)
+
+	// another process holds the lock
+	locked, err := SQLite.TryLock(ctx, conn, DefaultTable)
+	require.NoError(t, err)
+	require.True(t, locked)
+
+	host, _ := os.Hostname()
+	holder := fmt.Sprintf("pid %d on %s since ", os.Getpid(), host)
+
+	started := time.Now()
+	_, err = mg.Migrate(ctx, -1, conn)
+	require.Error(t, err)
+	require.True(t, time.Since(started) >= opts.LockWait, "the migration did not wait for the lock")
+	require.Contains(t, err.Error(), "timed out after 600ms waiting for migrations lock held by "+holder)
+	require.Contains(t, err.Error(), "(release it with Unlock, e.g. catena db:unlock, if the process has exited)")
+
+	locked, err = SQLite.TryLock(ctx, conn, DefaultTable)
+	require.NoError(t, err)
+	require.False(t, locked, "the lock should still be held by the other process")
+
+	// the migration proceeds once the lock is released while it is waiting
+	opts.LockWait = time.Minute
+	mg.SetOptions(opts)
+	time.AfterFunc(300*time.Millisecond, func() { SQLite.Unlock(ctx, conn, DefaultTable) })
+
+	_, err = mg.Migrate(ctx, -1, conn)
+	require.NoError(t, err)
+
+	current, err := mg.Current(ctx, conn)
+	require.NoError(t, err)
+	require.True(t, current.Active)
+
+	locked, err = SQLite.TryLock(ctx, conn, DefaultTable)
+	require.NoError(t, err)
+	require.True(t, locked, "the lock should be released after migrating")
+
+	// the lock row of a process that exited while holding it is released by Unlock
+	released, err := mg.Unlock(ctx, conn)
+	require.NoError(t, err)
+	require.True(t, released)
+
+	released, err = mg.Unlock(ctx, conn)
+	require.NoError(t, err)
+	require.False(t, released, "the lock should not be held")
+
+	_, err = mg.Migrate(ctx, -1, conn)
+	require.NoError(t, err)
+
+	// session locks are released by the database when their session ends
+	pg, err := NewMigrator(Postgres, "")
+	require.NoError(t, err)
+	_, err = pg.Unlock(ctx, conn)
+	require.EqualError(t, err, "the postgres migrations lock is released when the session that holds it ends and cannot be released by another process")
+}
+
 // Test the migrations themselves -- runs database commands.
 func TestDatabase(t *testing.T) {
 	// postgres://localhost:5432/catena_test?sslmode=disable
@@ -43,4 +468,774 @@ func TestDatabase(t *testing.T) {
 
 	err = Refresh(conn)
 	require.NoError(t, err)
+
+	modified, err := Verify(conn)
+	require.NoError(t, err)
+	require.Empty(t, modified)
+
+	// Planning a migration to the current revision should not require any steps
+	current, err := Current(conn)
+	require.NoError(t, err)
+	steps, err := Plan(current.Revision, conn)
+	require.NoError(t, err)
+	require.Empty(t, steps)
+}
+
+// Test that squashing migrations generates an equivalent baseline migration.
+func TestSquash(t *testing.T) {
+	Isolate(t)
+	dir := t.TempDir()
+	files := map[string]string{
+		"9001_notes.sql":   "-- migrate: up\nCREATE TABLE notes (id integer PRIMARY KEY)\n-- migrate: down\nDROP TABLE notes;",
+		"9002_body.sql":    "-- migrate: up\nALTER TABLE notes ADD COLUMN body text;\n-- migrate: up sqlite\nALTER TABLE notes ADD body text;\n-- migrate: down\nALTER TABLE notes DROP COLUMN body;",
+		"9003_authors.sql": "-- migrate: up\nCREATE TABLE authors (id integer PRIMARY KEY);\n-- migrate: down\nDROP TABLE authors;",
+	}
+	for name, src := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(src), 0644))
+	}
+	require.NoError(t, Register(os.DirFS(dir)))
+
+	_, _, err := Squash(9004, dir, "", false)
+	require.EqualError(t, err, "no migration found for revision 9004")
+
+	// the baseline cannot be written alongside the migrations it replaces unless they
+	// are removed, since both would be registered with the same revision
+	_, _, err = Squash(9002, dir, "", false)
+	require.EqualError(t, err, "cannot write the baseline to "+dir+" alongside the migrations that it replaces, which have the same revision: remove them or write the baseline to another directory")
+	_, _, err = Squash(9002, dir, filepath.Join(dir, "."), false)
+	require.Error(t, err)
+	require.NoFileExists(t, filepath.Join(dir, "9002_baseline.sql"))
+
+	// written to another directory, the replaced migrations are kept and the directory
+	// can still be registered
+	out := t.TempDir()
+	path, replaced, err := Squash(9002, dir, out, false)
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(out, "9002_baseline.sql"), path)
+	require.Equal(t, []string{filepath.Join(dir, "9001_notes.sql"), filepath.Join(dir, "9002_body.sql")}, replaced)
+	require.FileExists(t, filepath.Join(dir, "9001_notes.sql"))
+	require.FileExists(t, filepath.Join(dir, "9002_body.sql"))
+
+	Isolate(t)
+	require.NoError(t, Register(os.DirFS(dir)))
+	require.Equal(t, 4, Num())
+
+	_, replaced, err = Squash(9002, dir, "", true)
+	require.NoError(t, err)
+	require.Len(t, replaced, 2)
+	require.NoFileExists(t, filepath.Join(dir, "9001_notes.sql"))
+	require.NoFileExists(t, filepath.Join(dir, "9002_body.sql"))
+	require.FileExists(t, filepath.Join(dir, "9002_baseline.sql"))
+	require.FileExists(t, filepath.Join(dir, "9003_authors.sql"))
+
+	// the squashed directory registers the baseline in place of the replaced migrations
+	Isolate(t)
+	require.NoError(t, Register(os.DirFS(dir)))
+	require.Equal(t, 3, Num())
+
+	m, err := Parse(path)
+	require.NoError(t, err)
+	require.True(t, m.Squashed())
+	require.Equal(t, int64(9002), m.Revision)
+	require.Equal(t, "CREATE TABLE notes (id integer PRIMARY KEY)\n;\nALTER TABLE notes ADD COLUMN body text;", m.UpSQL())
+	require.Equal(t, "ALTER TABLE notes DROP COLUMN body;\nDROP TABLE notes;", m.DownSQL())
+
+	defer SetDialect(Postgres)
+	SetDialect(SQLite)
+	require.Equal(t, "CREATE TABLE notes (id integer PRIMARY KEY)\n;\nALTER TABLE notes ADD body text;", m.UpSQL())
+}
+
+// Test that databases migrated before a squash adopt the baseline, that databases within
+// the squashed range are refused and that new databases only apply the baseline.
+func TestSquashedDatabase(t *testing.T) {
+	SetDialect(SQLite)
+	defer SetDialect(Postgres)
+
+	dir := t.TempDir()
+	files := fstest.MapFS{
+		"9001_notes.sql":   {Data: []byte("-- migrate: up\nCREATE TABLE notes (id integer PRIMARY KEY);\n-- migrate: down\nDROP TABLE notes;")},
+		"9002_body.sql":    {Data: []byte("-- migrate: up\nALTER TABLE notes ADD COLUMN body text;\n-- migrate: down\nALTER TABLE notes DROP COLUMN body;")},
+		"9003_authors.sql": {Data: []byte("-- migrate: up\nCREATE TABLE authors (id integer PRIMARY KEY);\n-- migrate: down\nDROP TABLE authors;")},
+	}
+	for name, f := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), f.Data, 0644))
+	}
+
+	open := func(name string) *sql.DB {
+		conn, err := sql.Open("sqlite", filepath.Join(dir, name))
+		require.NoError(t, err, "could not open database")
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+
+	// migrate one database completely and another partially before the squash
+	full, partial := open("full.db"), open("partial.db")
+	Isolate(t)
+	require.NoError(t, Register(files))
+
+	n, err := Migrate(-1, full)
+	require.NoError(t, err)
+	require.Equal(t, 3, n)
+
+	n, err = Migrate(9001, partial)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+
+	path, _, err := Squash(9002, dir, t.TempDir(), false)
+	require.NoError(t, err)
+	baseline, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	Isolate(t)
+	require.NoError(t, Register(fstest.MapFS{
+		"9002_baseline.sql": {Data: baseline},
+		"9003_authors.sql":  files["9003_authors.sql"],
+	}))
+
+	// the fully migrated database adopts the baseline as the revision it replaced
+	n, err = Migrate(-1, full)
+	require.NoError(t, err)
+	require.Zero(t, n)
+
+	m, err := Revision(9002, full)
+	require.NoError(t, err)
+	require.True(t, m.Active)
+	require.Equal(t, "baseline", m.Name)
+	require.False(t, m.Modified())
+
+	var name, checksum string
+	require.NoError(t, full.QueryRow("SELECT name, checksum FROM migrations WHERE revision=9002").Scan(&name, &checksum))
+	require.Equal(t, "baseline", name)
+	require.Equal(t, m.Checksum(), checksum)
+
+	modified, err := Verify(full)
+	require.NoError(t, err)
+	require.Empty(t, modified)
+
+	// the partially migrated database cannot be represented by the baseline
+	_, err = Migrate(-1, partial)
+	require.EqualError(t, err, "database is at revision 9001 which was squashed into baseline revision 9002: migrate to revision 9002 with a version of catena from before the squash")
+
+	// a new database only applies the baseline, which can be rolled back and reapplied
+	fresh := open("fresh.db")
+	for i := 0; i < 2; i++ {
+		n, err = Migrate(-1, fresh)
+		require.NoError(t, err)
+		require.Equal(t, 2, n)
+
+		_, err = fresh.Exec("INSERT INTO notes (id, body) VALUES (1, 'squashed')")
+		require.NoError(t, err)
+
+		n, err = Migrate(0, fresh)
+		require.NoError(t, err)
+		require.Equal(t, 2, n)
+
+		var tables int
+		require.NoError(t, fresh.QueryRow("SELECT count(*) FROM sqlite_master WHERE type='table' AND name IN ('notes', 'authors')").Scan(&tables))
+		require.Zero(t, tables)
+	}
+
+	var revisions int
+	require.NoError(t, fresh.QueryRow("SELECT count(*) FROM migrations WHERE revision=9001").Scan(&revisions))
+	require.Zero(t, revisions, "squashed revisions are not tracked by new databases")
+}
+
+// Test that an existing database is only baselined if it has the expected schema.
+func TestBaseline(t *testing.T) {
+	Isolate(t)
+	SetDialect(SQLite)
+	defer SetDialect(Postgres)
+
+	fsys := fstest.MapFS{
+		"9101_notes.sql": {Data: []byte("-- migrate: up\nCREATE TABLE IF NOT EXISTS notes (id integer PRIMARY KEY, \"Body\" text DEFAULT 'a, b', CONSTRAINT body_uniq UNIQUE (\"Body\"));\n-- migrate: down\nDROP TABLE notes;")},
+		"9102_tags.sql":  {Data: []byte("-- migrate: up\nCREATE TABLE tags (id integer PRIMARY KEY, name text);\nALTER TABLE notes ADD COLUMN tag_id integer;\nCREATE TABLE scratch (id integer);\nDROP TABLE scratch;\n-- migrate: down\nDROP TABLE tags;")},
+		"9103_extra.sql": {Data: []byte("-- migrate: up\nCREATE TABLE extra (id integer);\n-- migrate: down\nDROP TABLE extra;")},
+	}
+	require.NoError(t, Register(fsys))
+
+	conn, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "catena.db"))
+	require.NoError(t, err, "could not open database")
+	defer conn.Close()
+
+	_, err = conn.Exec("CREATE TABLE notes (id integer PRIMARY KEY, body text)")
+	require.NoError(t, err)
+
+	_, err = Baseline(9102, conn)
+	require.EqualError(t, err, "cannot baseline revision 9102, the database is missing column notes.tag_id, table tags")
+
+	_, err = conn.Exec("ALTER TABLE notes ADD COLUMN tag_id integer")
+	require.NoError(t, err)
+	_, err = conn.Exec("CREATE TABLE tags (id integer PRIMARY KEY, name text)")
+	require.NoError(t, err)
+
+	n, err := Baseline(9102, conn)
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+
+	current, err := Current(conn)
+	require.NoError(t, err)
+	require.Equal(t, int64(9102), current.Revision)
+
+	steps, err := Plan(-1, conn)
+	require.NoError(t, err)
+	require.Len(t, steps, 1)
+	require.Equal(t, int64(9103), steps[0].Revision)
+}
+
+// Test that round trips detect down migrations that do not undo their up migration.
+func TestRoundTrip(t *testing.T) {
+	SetDialect(SQLite)
+	defer SetDialect(Postgres)
+
+	open := func() *sql.DB {
+		conn, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "catena.db"))
+		require.NoError(t, err, "could not open database")
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+
+	t.Run("Reversible", func(t *testing.T) {
+		Isolate(t)
+		require.NoError(t, Register(fstest.MapFS{
+			"9201_notes.sql": {Data: []byte("-- migrate: up\nCREATE TABLE notes (id integer PRIMARY KEY, body text);\n-- migrate: down\nDROP TABLE notes;")},
+			"9202_index.sql": {Data: []byte("-- migrate: up\nCREATE INDEX notes_body ON notes (body);\n-- migrate: down\nDROP INDEX notes_body;")},
+			"R__bodies.sql":  {Data: []byte("-- migrate: up\nCREATE VIEW IF NOT EXISTS note_bodies AS SELECT body FROM notes;")},
+		}))
+
+		conn := open()
+		n, err := RoundTrip(conn)
+		require.NoError(t, err)
+		require.Equal(t, 2, n)
+
+		// The database is left as Migrate(-1) would leave it, repeatables included
+		steps, err := Plan(-1, conn)
+		require.NoError(t, err)
+		require.Empty(t, steps)
+		require.True(t, Repeatables()[0].Active)
+		_, err = conn.Exec("SELECT count(*) FROM note_bodies")
+		require.NoError(t, err)
+
+		// A scratch database is required
+		_, err = RoundTrip(conn)
+		require.EqualError(t, err, "round trips require a scratch database but revision 9201 has been applied")
+
+		// Rolling back must clear the bookkeeping of the migrations
+		_, err = Migrate(0, conn)
+		require.NoError(t, err)
+
+		var (
+			active   bool
+			applied  sql.NullTime
+			checksum sql.NullString
+		)
+		require.NoError(t, conn.QueryRow("SELECT active, applied, checksum FROM migrations WHERE revision = 9202").Scan(&active, &applied, &checksum))
+		require.False(t, active)
+		require.False(t, applied.Valid, "applied timestamp was not cleared on rollback")
+		require.False(t, checksum.Valid, "checksum was not cleared on rollback")
+	})
+
+	t.Run("Irreversible", func(t *testing.T) {
+		Isolate(t)
+		require.NoError(t, Register(fstest.MapFS{
+			"9201_notes.sql": {Data: []byte("-- migrate: up\nCREATE TABLE notes (id integer PRIMARY KEY);\n-- migrate: down\nDROP TABLE notes;")},
+			"9202_body.sql":  {Data: []byte("-- migrate: up\nALTER TABLE notes ADD COLUMN body text;\n-- migrate: down\nSELECT 1;")},
+		}))
+
+		n, err := RoundTrip(open())
+		require.EqualError(t, err, "rolling back revision 9202 (9202_body.sql) did not restore the schema: unexpected column notes.body")
+		require.Equal(t, 1, n)
+	})
+}
+
+// Test that the schema of a migrated database can be dumped, parsed and compared.
+func TestSchema(t *testing.T) {
+	SetDialect(SQLite)
+	defer SetDialect(Postgres)
+
+	Isolate(t)
+	require.NoError(t, Register(fstest.MapFS{
+		"9401_notes.sql": {Data: []byte("-- migrate: up\nCREATE TABLE notes (id integer PRIMARY KEY, body text NOT NULL DEFAULT '');\nCREATE INDEX notes_body ON notes (body);\n-- migrate: down\nDROP TABLE notes;")},
+	}))
+
+	conn, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "catena.db"))
+	require.NoError(t, err, "could not open database")
+	defer conn.Close()
+
+	_, err = Migrate(-1, conn)
+	require.NoError(t, err)
+
+	schema, err := Inspect(conn)
+	require.NoError(t, err)
+	require.Len(t, schema.Tables, 1, "bookkeeping tables should not be part of the schema")
+
+	var buf bytes.Buffer
+	require.NoError(t, schema.Dump(&buf))
+	require.Contains(t, buf.String(), "CREATE TABLE notes (\n    body TEXT NOT NULL DEFAULT '',\n    id INTEGER\n);")
+
+	parsed, err := ParseSchema(&buf)
+	require.NoError(t, err)
+	require.Equal(t, schema, parsed)
+	require.Empty(t, parsed.Diff(schema))
+
+	_, err = conn.Exec("DROP INDEX notes_body; ALTER TABLE notes ADD COLUMN title text; CREATE TABLE tags (name text);")
+	require.NoError(t, err)
+
+	actual, err := Inspect(conn)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"unexpected column notes.title",
+		"missing index notes.notes_body",
+		"unexpected table tags",
+	}, parsed.Diff(actual))
+}
+
+// Test that migrations that are applied, rolled back and that fail are logged.
+func TestHistory(t *testing.T) {
+	SetDialect(SQLite)
+	defer SetDialect(Postgres)
+
+	Isolate(t)
+	require.NoError(t, Register(fstest.MapFS{
+		"9501_notes.sql": {Data: []byte("-- migrate: up\nCREATE TABLE notes (id integer PRIMARY KEY);\n-- migrate: down\nDROP TABLE notes;")},
+		"9502_fails.sql": {Data: []byte("-- migrate: up\nINSERT INTO missing (id) VALUES (1);\n-- migrate: down\nSELECT 1;")},
+	}))
+
+	conn, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "catena.db"))
+	require.NoError(t, err, "could not open database")
+	defer conn.Close()
+
+	records, err := History(conn, 0)
+	require.NoError(t, err)
+	require.Empty(t, records)
+
+	_, err = Migrate(9501, conn)
+	require.NoError(t, err)
+
+	_, err = Migrate(-1, conn)
+	require.Error(t, err)
+
+	_, err = Migrate(0, conn)
+	require.NoError(t, err)
+
+	records, err = History(conn, 0)
+	require.NoError(t, err)
+	require.Len(t, records, 3)
+
+	// the history is newest first and the failure is kept even though it was rolled back
+	require.Equal(t, int64(9501), records[0].Revision)
+	require.Equal(t, Down, records[0].Direction)
+	require.True(t, records[0].Success)
+
+	require.Equal(t, int64(9502), records[1].Revision)
+	require.Equal(t, Up, records[1].Direction)
+	require.False(t, records[1].Success)
+	require.Contains(t, records[1].Error, "no such table: missing")
+
+	require.Equal(t, int64(9501), records[2].Revision)
+	require.Equal(t, "notes", records[2].Name)
+	require.Equal(t, Up, records[2].Direction)
+	require.True(t, records[2].Success)
+	require.Equal(t, CurrentOptions().Version, records[2].Version)
+	require.NotEmpty(t, records[2].Host)
+	require.NotEmpty(t, records[2].User)
+	require.False(t, records[2].Started.IsZero())
+
+	records, err = History(conn, 1)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+}
+
+// Test that timestamp revisions merged after later revisions were applied are detected.
+func TestOutOfOrder(t *testing.T) {
+	SetDialect(SQLite)
+	defer SetDialect(Postgres)
+
+	conn, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "catena.db"))
+	require.NoError(t, err, "could not open database")
+	defer conn.Close()
+
+	fsys := fstest.MapFS{
+		"0001_notes.sql":          {Data: []byte("-- migrate: up\nCREATE TABLE notes (id integer PRIMARY KEY);\n-- migrate: down\nDROP TABLE notes;")},
+		"20260102090000_tags.sql": {Data: []byte("-- migrate: up\nCREATE TABLE tags (id integer PRIMARY KEY);\n-- migrate: down\nDROP TABLE tags;")},
+	}
+
+	Isolate(t)
+	require.NoError(t, Register(fsys))
+
+	n, err := Migrate(-1, conn)
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+
+	// A branch with an earlier timestamp is merged after the later revision was applied
+	fsys["20260101120000_users.sql"] = &fstest.MapFile{Data: []byte("-- migrate: up\nCREATE TABLE users (id integer PRIMARY KEY);\n-- migrate: down\nDROP TABLE users;")}
+	Isolate(t)
+	require.NoError(t, Register(fsys))
+
+	_, err = Migrate(-1, conn)
+	require.EqualError(t, err, `revision(s) 20260101120000 "users" have not been applied but are older than applied revision 20260102090000 "tags": renumber them or allow out of order migrations`)
+
+	opts := CurrentOptions()
+	opts.OutOfOrder = true
+	SetOptions(opts)
+
+	n, err = Migrate(-1, conn)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+
+	m, err := Revision(20260101120000, conn)
+	require.NoError(t, err)
+	require.True(t, m.Active)
+
+	// New migrations continue to use timestamp revisions
+	path, err := New("comments", t.TempDir())
+	require.NoError(t, err)
+	require.Regexp(t, `/\d{14}_comments\.sql$`, path)
+}
+
+// Test that timeout directives are parsed, applied by the dialects and reported.
+func TestTimeouts(t *testing.T) {
+	SetDialect(SQLite)
+	defer SetDialect(Postgres)
+
+	Isolate(t)
+	fsys := fstest.MapFS{
+		"9601_index.sql": {Data: []byte("-- migrate: lock_timeout = 5s statement_timeout=10m\n-- migrate: up\nCREATE TABLE notes (id integer PRIMARY KEY);\n-- migrate: down\nDROP TABLE notes;")},
+		"9602_notes.sql": {Data: []byte("-- migrate: up\nSELECT 1;\n-- migrate: down\nSELECT 1;")},
+	}
+	require.NoError(t, Register(fsys))
+
+	conn, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "catena.db"))
+	require.NoError(t, err, "could not open database")
+	defer conn.Close()
+
+	m, err := Revision(9601, conn)
+	require.NoError(t, err)
+	lock, statement := m.Timeouts()
+	require.Equal(t, 5*time.Second, lock)
+	require.Equal(t, 10*time.Minute, statement)
+	require.Contains(t, m.String(), "lock_timeout: 5s\nstatement_timeout: 10m0s\n")
+
+	// migrations without directives use the defaults
+	opts := CurrentOptions()
+	opts.LockTimeout = 2 * time.Second
+	SetOptions(opts)
+
+	m, err = Revision(9602, conn)
+	require.NoError(t, err)
+	lock, statement = m.Timeouts()
+	require.Equal(t, 2*time.Second, lock)
+	require.Zero(t, statement)
+
+	_, err = Migrate(-1, conn)
+	require.NoError(t, err)
+
+	// timeouts are reported with the migration that timed out so that it can be retried
+	locked := func(ctx context.Context, tx *sql.Tx) error { return errors.New("database is locked") }
+	require.NoError(t, RegisterGo(9603, "locked", locked, locked))
+
+	_, err = Migrate(-1, conn)
+	var timeout *TimeoutError
+	require.True(t, errors.As(err, &timeout), "expected a timeout error")
+	require.Equal(t, 2*time.Second, timeout.LockTimeout)
+	require.EqualError(t, err, "revision 9603 timed out (lock_timeout=2s, statement_timeout=default): could not apply revision 9603: migrations_test.go: database is locked")
+
+	// the dialects set the timeouts and reset them so they do not apply to later statements
+	set, reset := Postgres.Timeouts(5*time.Second, 0, true)
+	require.Equal(t, []string{"SET LOCAL lock_timeout = '5000ms'"}, set)
+	require.Equal(t, []string{"SET LOCAL lock_timeout TO DEFAULT"}, reset)
+
+	set, reset = Postgres.Timeouts(5*time.Second, 10*time.Minute, false)
+	require.Equal(t, []string{"SET lock_timeout = '5000ms'", "SET statement_timeout = '600000ms'"}, set)
+	require.Equal(t, []string{"RESET lock_timeout", "RESET statement_timeout"}, reset)
+	require.True(t, Postgres.TimedOut(fmt.Errorf("could not apply revision 1: %w", &pq.Error{Code: "55P03", Message: "canceling statement due to lock timeout"})))
+	require.True(t, Postgres.TimedOut(fmt.Errorf("could not apply revision 1: %w", &pq.Error{Code: "57014", Message: "Abbruch des Befehls wegen Zeitüberschreitung"})))
+	require.False(t, Postgres.TimedOut(&pq.Error{Code: "42P01", Message: "relation \"notes\" does not exist"}))
+	require.False(t, Postgres.TimedOut(errors.New("pq: canceling statement due to lock timeout")), "timeouts are identified by sqlstate")
+
+	set, _ = MySQL.Timeouts(1500*time.Millisecond, 0, true)
+	require.Equal(t, []string{"SET SESSION lock_wait_timeout = 2", "SET SESSION innodb_lock_wait_timeout = 2"}, set)
+
+	// mysql cannot limit the statements of migrations so statement timeouts are ignored
+	set, reset = MySQL.Timeouts(0, 10*time.Minute, false)
+	require.Empty(t, set)
+	require.Empty(t, reset)
+
+	set, reset = SQLite.Timeouts(5*time.Second, 10*time.Minute, true)
+	require.Empty(t, set)
+	require.Empty(t, reset)
+
+	// invalid settings are reported with their location
+	fsys = fstest.MapFS{"9604_bad.sql": {Data: []byte("-- migrate: lock_timeout=soon\n-- migrate: up\nSELECT 1;")}}
+	require.EqualError(t, Register(fsys), `9604_bad.sql:1: could not parse lock_timeout "soon", specify a duration such as 5s or 10m`)
+
+	fsys = fstest.MapFS{"9605_bad.sql": {Data: []byte("-- migrate: work_mem=64MB\n-- migrate: up\nSELECT 1;")}}
+	require.EqualError(t, Register(fsys), `9605_bad.sql:1: "work_mem" is not a valid migrate setting`)
+
+	fsys = fstest.MapFS{"9606_bad.sql": {Data: []byte("-- migrate: lock_timeout 5s\n-- migrate: up\nSELECT 1;")}}
+	require.EqualError(t, Register(fsys), `9606_bad.sql:1: "lock_timeout 5s" is not a valid migrate directive, specify settings as lock_timeout=5s`)
+}
+
+// Test that the status of registered and database-known migrations is reported.
+func TestStatus(t *testing.T) {
+	SetDialect(SQLite)
+	defer SetDialect(Postgres)
+
+	conn, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "catena.db"))
+	require.NoError(t, err, "could not open database")
+	defer conn.Close()
+
+	fsys := fstest.MapFS{
+		"9701_notes.sql": {Data: []byte("-- migrate: up\nCREATE TABLE notes (id integer PRIMARY KEY);\n-- migrate: down\nDROP TABLE notes;")},
+		"9702_tags.sql":  {Data: []byte("-- migrate: up\nCREATE TABLE tags (id integer PRIMARY KEY);\n-- migrate: down\nDROP TABLE tags;")},
+		"R__notes.sql":   {Data: []byte("-- migrate: up\nCREATE VIEW IF NOT EXISTS all_notes AS SELECT * FROM notes;")},
+	}
+
+	Isolate(t)
+	require.NoError(t, Register(fsys))
+
+	states := func() (states []string) {
+		statuses, err := Status(conn)
+		require.NoError(t, err)
+		for _, s := range statuses {
+			states = append(states, fmt.Sprintf("%d %s %s", s.Revision, s.Name, s.State))
+		}
+		return states
+	}
+
+	// the status of an uninitialized database is listed without changing it
+	require.Equal(t, []string{"9701 notes pending", "9702 tags pending", "0 notes pending"}, states())
+	require.Equal(t, []string{"9701 notes pending", "9702 tags pending", "0 notes pending"}, states())
+
+	_, err = Migrate(-1, conn)
+	require.NoError(t, err)
+
+	statuses, err := Status(conn)
+	require.NoError(t, err)
+	require.Len(t, statuses, 3)
+	require.Equal(t, Applied, statuses[0].State)
+	require.False(t, statuses[0].Applied.IsZero())
+	require.True(t, statuses[2].Repeatable)
+	require.Equal(t, Applied, statuses[2].State)
+
+	// migrations that were edited, removed or added are reported rather than errors
+	delete(fsys, "9702_tags.sql")
+	fsys["9701_notes.sql"] = &fstest.MapFile{Data: []byte("-- migrate: up\nCREATE TABLE notes (id integer PRIMARY KEY, body text);\n-- migrate: down\nDROP TABLE notes;")}
+	fsys["9703_users.sql"] = &fstest.MapFile{Data: []byte("-- migrate: up\nCREATE TABLE users (id integer PRIMARY KEY);\n-- migrate: down\nDROP TABLE users;")}
+	fsys["R__notes.sql"] = &fstest.MapFile{Data: []byte("-- migrate: up\nCREATE VIEW IF NOT EXISTS note_ids AS SELECT id FROM notes;")}
+
+	Isolate(t)
+	require.NoError(t, Register(fsys))
+	require.Equal(t, []string{"9701 notes modified", "9702 tags missing-locally", "9703 users pending", "0 notes pending"}, states())
+
+	data, err := json.Marshal(Modified)
+	require.NoError(t, err)
+	require.Equal(t, `"modified"`, string(data))
+}
+
+// Test that migrators manage their own migrations independently of each other.
+func TestMigrator(t *testing.T) {
+	ctx := context.Background()
+	conn, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "catena.db"))
+	require.NoError(t, err, "could not open database")
+	defer conn.Close()
+
+	_, err = NewMigrator(SQLite, "plugin migrations")
+	require.EqualError(t, err, `"plugin migrations" is not a valid migrations table name`)
+
+	app, err := NewMigrator(SQLite, "")
+	require.NoError(t, err)
+	require.Equal(t, DefaultTable, app.Table())
+	require.NoError(t, app.Register(fstest.MapFS{
+		"0001_notes.sql": {Data: []byte("-- migrate: up\nCREATE TABLE notes (id integer PRIMARY KEY);\n-- migrate: down\nDROP TABLE notes;")},
+	}))
+
+	plugin, err := NewMigrator(SQLite, "plugin_migrations")
+	require.NoError(t, err)
+	require.NoError(t, plugin.Register(fstest.MapFS{
+		"0001_tags.sql":   {Data: []byte("-- migrate: up\nCREATE TABLE tags (id integer PRIMARY KEY);\n-- migrate: down\nDROP TABLE tags;")},
+		"0002_labels.sql": {Data: []byte("-- migrate: up\nCREATE TABLE labels (id integer PRIMARY KEY);\n-- migrate: down\nDROP TABLE labels;")},
+		"R__tag_ids.sql":  {Data: []byte("-- migrate: up\nCREATE VIEW IF NOT EXISTS tag_ids AS SELECT id FROM tags;")},
+	}))
+	require.Equal(t, 3, plugin.Num())
+	require.Len(t, plugin.Repeatables(), 1)
+
+	// migrators start with the default settings but are configured independently
+	opts := plugin.Options()
+	require.Equal(t, CurrentOptions().LockWait, opts.LockWait)
+	opts.Version = "plugin-v1"
+	plugin.SetOptions(opts)
+	require.Equal(t, CurrentOptions().Version, app.Options().Version)
+
+	// the migrators manage different databases concurrently
+	other, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "other.db"))
+	require.NoError(t, err, "could not open database")
+	defer other.Close()
+
+	var wg sync.WaitGroup
+	counts := make([]int, 2)
+	errs := make([]error, 2)
+	for i, db := range []*sql.DB{conn, other} {
+		wg.Add(1)
+		go func(i int, db *sql.DB) {
+			defer wg.Done()
+			counts[i], errs[i] = app.Migrate(ctx, -1, db)
+		}(i, db)
+	}
+	wg.Wait()
+
+	require.NoError(t, errs[0])
+	require.NoError(t, errs[1])
+	require.Equal(t, []int{1, 1}, counts)
+
+	// the migrators share a database without sharing their bookkeeping or their lock;
+	// migrations can be inspected while their migrator is migrating the database
+	tags, err := plugin.Revision(ctx, 1, nil)
+	require.NoError(t, err)
+
+	done := make(chan string)
+	go func() {
+		var out string
+		for i := 0; i < 10; i++ {
+			out = tags.String()
+		}
+		done <- out
+	}()
+
+	n, err := plugin.Migrate(ctx, -1, conn)
+	require.NoError(t, err)
+	require.Equal(t, 3, n)
+	require.Contains(t, <-done, "successors: 1\n")
+
+	current, err := plugin.Current(ctx, conn)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), current.Revision)
+
+	var tables []string
+	rows, err := conn.Query("SELECT name FROM sqlite_master WHERE type = 'table' AND name LIKE '%migration%' ORDER BY name")
+	require.NoError(t, err)
+	for rows.Next() {
+		var name string
+		require.NoError(t, rows.Scan(&name))
+		tables = append(tables, name)
+	}
+	require.NoError(t, rows.Err())
+	require.Equal(t, []string{"migration_history", "migrations", "migrations_lock", "plugin_migrations", "plugin_migrations_history", "plugin_migrations_lock", "plugin_migrations_repeatable", "repeatable_migrations"}, tables)
+
+	records, err := plugin.History(ctx, conn, 0)
+	require.NoError(t, err)
+	require.Len(t, records, 3)
+	require.Equal(t, "plugin-v1", records[0].Version)
+
+	records, err = app.History(ctx, conn, 1)
+	require.NoError(t, err)
+	require.Equal(t, CurrentOptions().Version, records[0].Version)
+
+	// rolling back the plugin does not affect the application migrations
+	_, err = plugin.Migrate(ctx, 0, conn)
+	require.NoError(t, err)
+
+	current, err = app.Current(ctx, conn)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), current.Revision)
+
+	schema, err := app.Inspect(ctx, conn)
+	require.NoError(t, err)
+	require.Contains(t, schema.Tables, "notes")
+	require.Contains(t, schema.Tables, "plugin_migrations", "only the migrator's own bookkeeping tables are excluded")
+
+	// canceled contexts stop migrations before they begin
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = plugin.Migrate(canceled, -1, conn)
+	require.Error(t, err)
+
+	current, err = plugin.Current(ctx, conn)
+	require.NoError(t, err)
+	require.Zero(t, current.Revision)
+}
+
+// Test that only identifiers and table name literals are renamed for a custom table,
+// so that the descriptions in the migrations schema are not rewritten.
+func TestRenameTables(t *testing.T) {
+	plugin, err := NewMigrator(Postgres, "plugin_migrations")
+	require.NoError(t, err)
+
+	query := "SELECT 'migrations', 'pending migrations' FROM migrations JOIN \"migration_history\" USING (revision) -- count migrations"
+	require.Equal(t, "SELECT 'plugin_migrations', 'pending migrations' FROM plugin_migrations JOIN \"plugin_migrations_history\" USING (revision) -- count migrations", RenameTables(plugin, query))
+
+	app, err := NewMigrator(Postgres, "")
+	require.NoError(t, err)
+	require.Equal(t, query, RenameTables(app, query))
+
+	schema, err := plugin.Revision(context.Background(), 0, nil)
+	require.NoError(t, err)
+
+	sql := RenameTables(plugin, schema.UpSQL())
+	require.Contains(t, sql, `COMMENT ON TABLE "plugin_migrations" IS 'Manages the state of database by enabling migrations and rollbacks';`)
+	require.Contains(t, sql, `COMMENT ON TABLE "plugin_migrations_repeatable" IS 'Manages the state of repeatable migrations, which are re-applied when their sql changes';`)
+	require.Contains(t, sql, `table_name = 'plugin_migrations' AND column_name = 'revision'`)
+	require.Contains(t, sql, `ALTER TABLE plugin_migrations ALTER COLUMN "revision" TYPE bigint;`)
+	require.NotRegexp(t, `[^_]migrations_lock|repeatable_migrations|[^_]migration_history`, sql)
+}
+
+// Test that repeatable migrations are applied after versioned migrations and are only
+// re-applied when they change.
+func TestRepeatable(t *testing.T) {
+	SetDialect(SQLite)
+	defer SetDialect(Postgres)
+
+	conn, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "catena.db"))
+	require.NoError(t, err, "could not open database")
+	defer conn.Close()
+
+	register := func(t *testing.T, view string) {
+		Isolate(t)
+		require.NoError(t, Register(fstest.MapFS{
+			"9301_notes.sql":    {Data: []byte("-- migrate: up\nCREATE TABLE notes (id integer PRIMARY KEY, body text);\n-- migrate: down\nDROP TABLE notes;")},
+			"R__note_views.sql": {Data: []byte("-- migrate: up\nDROP VIEW IF EXISTS note_bodies;\n" + view)},
+		}))
+	}
+
+	t.Run("Applied", func(t *testing.T) {
+		register(t, "CREATE VIEW note_bodies AS SELECT body FROM notes;")
+		require.Len(t, Repeatables(), 1)
+		require.True(t, Repeatables()[0].Repeatable())
+
+		steps, err := Plan(-1, conn)
+		require.NoError(t, err)
+		require.Len(t, steps, 2)
+		require.Equal(t, int64(9301), steps[0].Revision)
+		require.Equal(t, "note views", steps[1].Name)
+
+		// Repeatable migrations are only applied when migrating to the latest revision
+		steps, err = Plan(9301, conn)
+		require.NoError(t, err)
+		require.Len(t, steps, 1)
+
+		n, err := Migrate(-1, conn)
+		require.NoError(t, err)
+		require.Equal(t, 2, n)
+
+		n, err = Migrate(-1, conn)
+		require.NoError(t, err)
+		require.Equal(t, 0, n, "unchanged repeatable migration was re-applied")
+	})
+
+	t.Run("Changed", func(t *testing.T) {
+		register(t, "CREATE VIEW note_bodies AS SELECT id, body FROM notes;")
+
+		n, err := Migrate(-1, conn)
+		require.NoError(t, err)
+		require.Equal(t, 1, n, "changed repeatable migration was not re-applied")
+
+		var rows int
+		require.NoError(t, conn.QueryRow("SELECT count(*) FROM repeatable_migrations").Scan(&rows))
+		require.Equal(t, 1, rows)
+
+		_, err = conn.Exec("SELECT id, body FROM note_bodies")
+		require.NoError(t, err)
+	})
+
+	fsys := fstest.MapFS{"R__bad.sql": {Data: []byte("-- migrate: no-transaction\n-- migrate: up\nSELECT 1;")}}
+	require.EqualError(t, Register(fsys), "R__bad.sql: repeatable migrations cannot use the no-transaction or squashed directives")
 }
@@ -0,0 +1,252 @@
+package migrations
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bbengfort/catena/logs"
+)
+
+// DefaultTable is the name of the table that records the state of the migrations.
+const DefaultTable = "migrations"
+
+// The file of the embedded migration that creates the bookkeeping tables (revision 0).
+const schemaFile = "0000_migrations_schema.sql"
+
+// Migrator manages a set of registered migrations and their state in a database of a
+// single dialect. The package level functions use a default migrator that has the
+// migrations embedded in this package registered; applications that manage more than
+// one database, or more than one set of migrations in the same database, create a
+// migrator for each with NewMigrator. The methods of a migrator, and of the migrations
+// it returns, are safe for concurrent use, although migrations should be registered
+// before it is used.
+type Migrator struct {
+	mu          sync.RWMutex
+	migrations  []Migration  // the migrations sorted by revision, starting with the schema
+	repeatables []Migration  // the repeatable migrations sorted by name
+	dialect     Dialect      // the dialect of the database the migrations are run against
+	logger      *logs.Logger // reports the progress of long running operations
+	table       string       // the name of the table that records the state of migrations
+	renamed     bool         // if the bookkeeping tables are renamed after a custom table
+	opts        Options      // the settings of the migrator
+}
+
+// the default migrator used by the package level functions
+var std = &Migrator{dialect: Postgres, logger: logs.New("migrations"), table: DefaultTable, opts: Options{LockWait: 1 * time.Minute, Version: "unknown"}}
+
+// Options configure how a migrator applies and creates migrations. The lock and
+// statement timeouts can be overridden by a migration with "-- migrate: lock_timeout=5s"
+// and "-- migrate: statement_timeout=10m" directives. The default migrator waits a
+// minute for the migrations lock and records the version "unknown" until it is
+// configured with SetOptions.
+type Options struct {
+	LockWait           time.Duration // how long to wait for another process to release the migrations lock
+	LockTimeout        time.Duration // the default lock timeout of migration statements, zero uses the database's
+	StatementTimeout   time.Duration // the default statement timeout of migration statements, zero uses the database's
+	OutOfOrder         bool          // allow migrations older than the latest applied revision to be applied
+	TimestampRevisions bool          // create migrations whose revision is the UTC time they were created
+	Version            string        // the version of the application recorded in the migration history
+}
+
+// CurrentOptions returns the settings of the default migrator.
+func CurrentOptions() Options {
+	return std.Options()
+}
+
+// SetOptions replaces the settings of the default migrator.
+func SetOptions(o Options) {
+	std.SetOptions(o)
+}
+
+// NewMigrator returns a migrator that runs migrations against databases of the specified
+// dialect and records their state in the named table, or DefaultTable if it is empty.
+// The other bookkeeping tables are named after the table with the suffixes _lock,
+// _repeatable and _history unless the default table is used, so that migrators with
+// different tables can manage independent sets of migrations in the same database. The
+// migrator only has the migration that creates the bookkeeping tables registered and
+// starts with the settings of the default migrator, which can be changed with SetOptions.
+func NewMigrator(d Dialect, table string) (mg *Migrator, err error) {
+	if table == "" {
+		table = DefaultTable
+	}
+
+	if !identifier.MatchString(table) {
+		return nil, fmt.Errorf("%q is not a valid migrations table name", table)
+	}
+
+	mg = &Migrator{dialect: d, logger: logs.New("migrations"), table: table, opts: std.Options()}
+	mg.renamed = table != DefaultTable
+
+	var src []byte
+	if src, err = embedded.ReadFile(schemaFile); err != nil {
+		return nil, fmt.Errorf("could not read migrations schema: %s", err)
+	}
+
+	var m *Migration
+	if m, err = parse(schemaFile, src); err != nil {
+		return nil, err
+	}
+
+	mg.insert(*m)
+	return mg, nil
+}
+
+// Table names are interpolated into queries so they must be plain identifiers.
+var identifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Dialect returns the dialect of the database that migrations are run against.
+func (mg *Migrator) Dialect() Dialect {
+	mg.mu.RLock()
+	defer mg.mu.RUnlock()
+	return mg.dialect
+}
+
+// SetDialect specifies the dialect of the database that migrations are run against.
+func (mg *Migrator) SetDialect(d Dialect) {
+	mg.mu.Lock()
+	defer mg.mu.Unlock()
+	mg.dialect = d
+}
+
+// SetLogger replaces the logger used by the migrator.
+func (mg *Migrator) SetLogger(l *logs.Logger) {
+	mg.mu.Lock()
+	defer mg.mu.Unlock()
+	mg.logger = l
+}
+
+// Options returns the settings of the migrator.
+func (mg *Migrator) Options() Options {
+	mg.mu.RLock()
+	defer mg.mu.RUnlock()
+	return mg.options()
+}
+
+// SetOptions replaces the settings of the migrator.
+func (mg *Migrator) SetOptions(o Options) {
+	mg.mu.Lock()
+	defer mg.mu.Unlock()
+	mg.opts = o
+}
+
+// Returns the settings of the migrator, which the caller must hold the lock to read.
+func (mg *Migrator) options() Options {
+	return mg.opts
+}
+
+// Table returns the name of the table that records the state of the migrations.
+func (mg *Migrator) Table() string {
+	return mg.table
+}
+
+// Returns the name of the bookkeeping table with the specified default name.
+func (mg *Migrator) rename(name string) string {
+	if !mg.renamed {
+		return name
+	}
+
+	switch name {
+	case "migrations":
+		return mg.table
+	case "migrations_lock":
+		return mg.table + "_lock"
+	case "repeatable_migrations":
+		return mg.table + "_repeatable"
+	case "migration_history":
+		return mg.table + "_history"
+	default:
+		return name
+	}
+}
+
+// Rewrites the names of the bookkeeping tables in the source of the lexer, a query or a
+// statement of the migrations schema, if the migrator does not use the default table.
+// Only identifiers
+// are renamed, including those in dollar-quoted function bodies, along with string
+// literals that consist of nothing but a table name, e.g. to look the table up in the
+// information schema; comments and any other strings are left as they are.
+func (mg *Migrator) renameTables(lex *lexer) string {
+	if !mg.renamed {
+		return lex.src
+	}
+
+	builder := &strings.Builder{}
+	for {
+		tok, err := lex.next()
+		if err != nil {
+			if err != io.EOF {
+				// the bookkeeping queries and schema are constants so this is a programming error
+				panic(fmt.Errorf("could not rename tables: %s", err))
+			}
+			break
+		}
+
+		switch {
+		case tok.kind == tokenWord:
+			builder.WriteString(mg.rename(tok.text))
+		case tok.kind == tokenIdent, tok.kind == tokenString && tok.text[0] == '\'':
+			q := tok.text[:1]
+			builder.WriteString(q + mg.rename(tok.text[1:len(tok.text)-1]) + q)
+		case tok.kind == tokenString && tok.text[0] == '$':
+			tag := tok.text[:strings.IndexByte(tok.text[1:], '$')+2]
+			builder.WriteString(tag + mg.renameTables(newLexer(tok.text[len(tag):len(tok.text)-len(tag)])) + tag)
+		default:
+			builder.WriteString(tok.text)
+		}
+	}
+	return builder.String()
+}
+
+// Rewrites the $n placeholders of the migrations bookkeeping queries with the
+// placeholders of the dialect and the bookkeeping tables with the names used by the
+// migrator. Only placeholders outside of strings, quoted identifiers and comments are
+// rewritten.
+func (mg *Migrator) rebind(query string) string {
+	query = mg.renameTables(newLexer(query))
+	if _, ok := mg.dialect.(postgres); ok {
+		return query
+	}
+
+	builder := &strings.Builder{}
+	lex := newLexer(query)
+	for param := false; ; {
+		tok, err := lex.next()
+		if err != nil {
+			if err != io.EOF {
+				// the bookkeeping queries are constants so this is a programming error
+				panic(fmt.Errorf("could not rebind query: %s", err))
+			}
+			break
+		}
+
+		if param {
+			param = false
+			if n, err := strconv.Atoi(tok.text); err == nil && tok.kind == tokenWord {
+				builder.WriteString(mg.dialect.Placeholder(n))
+				continue
+			}
+			builder.WriteByte('$')
+		}
+
+		if tok.kind == tokenPunct && tok.text == "$" {
+			param = true
+			continue
+		}
+		builder.WriteString(tok.text)
+	}
+	return builder.String()
+}
+
+// Returns the migrator that registered the migration, or the default migrator for
+// migrations that were parsed but not registered.
+func (m *Migration) migrator() *Migrator {
+	if m.mg != nil {
+		return m.mg
+	}
+	return std
+}
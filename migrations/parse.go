@@ -0,0 +1,632 @@
+package migrations
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/lib/pq"
+)
+
+// Parse a migration file into an unsynchronized migration struct. This function is used
+// by the makemigrations validator and though it can help users diagnose migration
+// parsing issues, is generally not useful outside of the package.
+func Parse(filename string) (m *Migration, err error) {
+	if !strings.HasSuffix(filename, ".sql") {
+		return nil, errors.New("migration filenames must end in .sql extension")
+	}
+
+	var src []byte
+	if src, err = ioutil.ReadFile(filename); err != nil {
+		return nil, fmt.Errorf("could not open %q: %s", filename, err)
+	}
+
+	return parse(filename, src)
+}
+
+// Parse the source of a migration file, splitting the up and down sections into the
+// individual statements that they contain. The original text of each statement is
+// preserved along with the line it starts on so that database errors can be reported
+// relative to the migration file. Unlike a naive split on semicolons, the parser is
+// aware of string literals, quoted identifiers, dollar-quoted function bodies and
+// comments, so a semicolon or -- inside any of these does not end a statement.
+func parse(filename string, src []byte) (m *Migration, err error) {
+	m = &Migration{
+		filename: filename,
+		dbsync:   false,
+	}
+
+	base := strings.TrimSuffix(filepath.Base(filename), ".sql")
+	if isRepeatable(filename) {
+		// repeatable migrations are identified by their name rather than a revision
+		m.repeatable = true
+		if m.Name = strings.Join(strings.Split(strings.TrimPrefix(base, repeatablePrefix), "_"), " "); m.Name == "" {
+			return nil, errors.New("must format repeatable migration filenames as R__description.sql")
+		}
+	} else {
+		parts := strings.Split(base, "_")
+		if len(parts) < 2 {
+			return nil, errors.New("must format migration filenames as XXXX_description.sql")
+		}
+
+		if m.Revision, err = strconv.ParseInt(parts[0], 10, 64); err != nil {
+			return nil, fmt.Errorf("could not parse revision from %q: %s", filename, err)
+		}
+
+		m.Name = strings.Join(parts[1:], " ")
+	}
+
+	var (
+		current  *[]statement // the section statements are currently being added to
+		stmt     *statement   // the statement currently being accumulated
+		end      int          // the offset of the end of the last token in stmt
+		comments []string     // the comments since the last statement
+		text     = string(src)
+		lex      = newLexer(text)
+	)
+
+	// Add the statement being accumulated to the current section
+	flush := func() {
+		if stmt != nil {
+			stmt.sql = text[stmt.offset:end]
+			*current = append(*current, *stmt)
+			stmt = nil
+		}
+	}
+
+	for {
+		var tok token
+		if tok, err = lex.next(); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, fmt.Errorf("%s:%s", filename, err)
+		}
+
+		switch tok.kind {
+		case tokenSpace:
+			continue
+		case tokenComment:
+			var (
+				args []string
+				ok   bool
+			)
+
+			if args, ok = directive(tok.text); !ok {
+				// comments inside of a statement are kept with the statement
+				if stmt != nil {
+					end = tok.offset + len(tok.text)
+				} else {
+					comments = append(comments, tok.text)
+				}
+				continue
+			}
+
+			// a directive of settings, e.g. lock_timeout=5s statement_timeout=10m
+			if len(args) > 0 && strings.Contains(args[0], "=") {
+				if err = m.settings(args); err != nil {
+					return nil, fmt.Errorf("%s:%d: %s", filename, tok.line, err)
+				}
+
+				flush()
+				comments = nil
+				continue
+			}
+
+			if len(args) > 0 && (args[0] == settingLockTimeout || args[0] == settingStatementTimeout) {
+				return nil, fmt.Errorf("%s:%d: %q is not a valid migrate directive, specify settings as %s=5s", filename, tok.line, strings.Join(args, " "), args[0])
+			}
+
+			if len(args) == 0 || len(args) > 2 || (len(args) == 2 && args[0] != "up" && args[0] != "down") {
+				return nil, fmt.Errorf("%s:%d: %q is not a valid migrate directive", filename, tok.line, strings.Join(args, " "))
+			}
+
+			// a directive ends any statement that was missing its semicolon
+			flush()
+			comments = nil
+
+			switch args[0] {
+			case "up":
+				current = &m.up
+			case "down":
+				current = &m.down
+			case "no-transaction":
+				m.notx = true
+			case "squashed":
+				m.squashed = true
+			default:
+				return nil, fmt.Errorf("%s:%d: %q is not a valid migrate directive", filename, tok.line, args[0])
+			}
+
+			// dialect specific sections replace the generic section for that dialect and
+			// are split with the lexical rules of the dialect
+			if args[0] == "up" || args[0] == "down" {
+				lex.mysql = false
+			}
+
+			if len(args) == 2 {
+				var d Dialect
+				if d, err = DialectFor(args[1]); err != nil {
+					return nil, fmt.Errorf("%s:%d: %s", filename, tok.line, err)
+				}
+				current = m.section(d, args[0])
+				lex.mysql = d == MySQL
+			}
+			continue
+		}
+
+		if current == nil {
+			return nil, fmt.Errorf("%s:%d: did not encounter a 'migrate:' directive", filename, tok.line)
+		}
+
+		if stmt == nil {
+			// ignore empty statements, e.g. from doubled semicolons
+			if tok.kind == tokenPunct && tok.text == ";" {
+				continue
+			}
+			stmt = &statement{offset: tok.offset, line: tok.line, comments: comments, mysql: lex.mysql}
+			comments = nil
+		}
+
+		end = tok.offset + len(tok.text)
+		if tok.kind == tokenPunct && tok.text == ";" {
+			flush()
+		}
+	}
+
+	// the final statement of the file does not require a semicolon
+	flush()
+
+	if m.repeatable && (m.notx || m.squashed) {
+		return nil, fmt.Errorf("%s: repeatable migrations cannot use the no-transaction or squashed directives", filename)
+	}
+	return m, nil
+}
+
+// The filename prefix of repeatable migrations, e.g. R__graph_views.sql
+const repeatablePrefix = "R__"
+
+// Returns true if the filename is a repeatable migration.
+func isRepeatable(filename string) bool {
+	return strings.HasPrefix(filepath.Base(filename), repeatablePrefix)
+}
+
+// Returns the arguments of a "-- migrate: arg ..." directive comment or false if the
+// comment is not a migrate directive. Arguments are lowercased.
+func directive(comment string) (args []string, ok bool) {
+	if !strings.HasPrefix(comment, "--") {
+		return nil, false
+	}
+
+	comment = strings.ToLower(strings.TrimSpace(strings.TrimLeft(comment, "-")))
+	if !strings.HasPrefix(comment, "migrate:") {
+		return nil, false
+	}
+
+	// settings may be written with spaces around the =, e.g. lock_timeout = 5s
+	comment = assignment.ReplaceAllString(strings.TrimPrefix(comment, "migrate:"), "=")
+	return strings.Fields(comment), true
+}
+
+// The = of a setting along with any whitespace around it.
+var assignment = regexp.MustCompile(`\s*=\s*`)
+
+// The settings that can be specified by a migrate directive.
+const (
+	settingLockTimeout      = "lock_timeout"
+	settingStatementTimeout = "statement_timeout"
+)
+
+// Parse the key=value arguments of a settings directive into the migration's timeouts.
+func (m *Migration) settings(args []string) (err error) {
+	for _, arg := range args {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("%q is not a valid migrate setting, specify as key=value", arg)
+		}
+
+		switch parts[0] {
+		case settingLockTimeout, settingStatementTimeout:
+			var timeout time.Duration
+			if timeout, err = time.ParseDuration(parts[1]); err != nil || timeout < 0 {
+				return fmt.Errorf("could not parse %s %q, specify a duration such as 5s or 10m", parts[0], parts[1])
+			}
+
+			if m.limits == nil {
+				m.limits = make(map[string]time.Duration)
+			}
+			m.limits[parts[0]] = timeout
+		default:
+			return fmt.Errorf("%q is not a valid migrate setting", parts[0])
+		}
+	}
+	return nil
+}
+
+// Returns the statements of the dialect specific section of the migration, marking the
+// section as specified so that it replaces the generic section even if it is empty.
+func (m *Migration) section(d Dialect, direction string) *[]statement {
+	if m.dialects == nil {
+		m.dialects = make(map[string]*section)
+	}
+
+	sec, ok := m.dialects[d.Name()]
+	if !ok {
+		sec = &section{}
+		m.dialects[d.Name()] = sec
+	}
+
+	stmts := &sec.up
+	if direction == "down" {
+		stmts = &sec.down
+	}
+
+	if *stmts == nil {
+		*stmts = []statement{}
+	}
+	return stmts
+}
+
+//===========================================================================
+// Statements
+//===========================================================================
+
+// The statements of the dialect specific sections of a migration file; a nil slice
+// means the section was not specified and the generic section is used instead.
+type section struct {
+	up   []statement
+	down []statement
+}
+
+// A single SQL statement from a migration file, including its terminating semicolon.
+type statement struct {
+	sql      string   // the original text of the statement from the migration file
+	line     int      // the line in the migration file that the statement starts on
+	offset   int      // the byte offset in the migration file the statement starts at
+	comments []string // the comments that precede the statement, e.g. lint markers
+	mysql    bool     // if the statement is from a mysql section and uses its lexical rules
+}
+
+// Returns a lexer for the statement with the lexical rules it was split with.
+func (s statement) lexer() *lexer {
+	lex := newLexer(s.sql)
+	lex.mysql = s.mysql
+	return lex
+}
+
+// Returns the line in the migration file that an error returned by the database when
+// executing the statement refers to. PostgreSQL reports the 1-indexed character
+// position in the query that caused the error; if it is not available then the first
+// line of the statement is returned.
+func (s statement) errorLine(err error) int {
+	var pqerr *pq.Error
+	if !errors.As(err, &pqerr) || pqerr.Position == "" {
+		return s.line
+	}
+
+	pos, perr := strconv.Atoi(pqerr.Position)
+	if perr != nil || pos < 1 {
+		return s.line
+	}
+
+	line := s.line
+	for _, r := range s.sql {
+		if pos--; pos == 0 {
+			break
+		}
+		if r == '\n' {
+			line++
+		}
+	}
+	return line
+}
+
+// SplitStatements splits SQL source that has no migrate directives, such as a seed file,
+// into its statements using the same lexer as migrations, so that semicolons inside of
+// strings, quoted identifiers, comments and function bodies do not end a statement.
+// Comments between statements are dropped and the last statement does not require a
+// semicolon. Errors are prefixed by the line number they occurred on.
+func SplitStatements(src string) (stmts []string, err error) {
+	var (
+		start = -1 // the offset of the statement being accumulated
+		end   int  // the offset of the end of the last token in the statement
+		lex   = newLexer(src)
+	)
+
+	for {
+		var tok token
+		if tok, err = lex.next(); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+
+		if tok.kind == tokenSpace || (start < 0 && tok.kind == tokenComment) {
+			continue
+		}
+
+		if start < 0 {
+			// ignore empty statements, e.g. from doubled semicolons
+			if tok.kind == tokenPunct && tok.text == ";" {
+				continue
+			}
+			start = tok.offset
+		}
+
+		end = tok.offset + len(tok.text)
+		if tok.kind == tokenPunct && tok.text == ";" {
+			stmts = append(stmts, src[start:end])
+			start = -1
+		}
+	}
+
+	if start >= 0 {
+		stmts = append(stmts, src[start:end])
+	}
+	return stmts, nil
+}
+
+// Joins the statements back together into a single query string.
+func joinStatements(stmts []statement) string {
+	sql := make([]string, 0, len(stmts))
+	for _, stmt := range stmts {
+		sql = append(sql, stmt.sql)
+	}
+	return strings.Join(sql, "\n")
+}
+
+// Normalizes the statements for hashing by removing comments and collapsing the
+// whitespace between tokens so that only changes to the SQL itself affect the result.
+// Whitespace inside of string literals, quoted identifiers and dollar-quoted bodies is
+// part of the SQL, so it is kept as is.
+func normalizeStatements(stmts []statement) string {
+	builder := &strings.Builder{}
+	for _, stmt := range stmts {
+		space := builder.Len() > 0
+		lex := stmt.lexer()
+		for {
+			tok, err := lex.next()
+			if err != nil {
+				break
+			}
+
+			if tok.kind == tokenSpace || tok.kind == tokenComment {
+				space = builder.Len() > 0
+				continue
+			}
+
+			if space {
+				builder.WriteByte(' ')
+				space = false
+			}
+			builder.WriteString(tok.text)
+		}
+	}
+	return builder.String()
+}
+
+//===========================================================================
+// SQL Lexer
+//===========================================================================
+
+// The lexical class of a token
+type tokenKind uint8
+
+const (
+	tokenSpace   tokenKind = iota // a run of whitespace
+	tokenComment                  // a -- line comment, a /* */ block comment or a MySQL # comment
+	tokenWord                     // a keyword, unquoted identifier or number
+	tokenIdent                    // a double quoted identifier or a MySQL backtick quoted identifier
+	tokenString                   // a quoted, escaped or dollar-quoted string literal
+	tokenPunct                    // any other single character, e.g. ; ( ) , or $
+)
+
+// A lexical token and its location in the source.
+type token struct {
+	kind   tokenKind
+	text   string // the original text of the token, including quotes
+	line   int    // the line the token starts on (1-indexed)
+	offset int    // the byte offset the token starts at
+}
+
+// lexer splits SQL source into tokens. It only understands as much of the PostgreSQL
+// lexical structure as is required to find where strings, quoted identifiers and
+// comments begin and end, which is enough to split statements and map positions back
+// to lines without ever modifying the original text. If mysql is set, the MySQL rules
+// are used instead: strings may be single or double quoted and contain backslash
+// escapes, identifiers are quoted with backticks, # starts a comment and there are no
+// dollar-quoted strings.
+type lexer struct {
+	src   string
+	pos   int
+	line  int
+	mysql bool
+}
+
+func newLexer(src string) *lexer {
+	return &lexer{src: src, line: 1}
+}
+
+// Returns the next token in the source or io.EOF if there are no more tokens.
+func (l *lexer) next() (tok token, err error) {
+	if l.pos >= len(l.src) {
+		return token{}, io.EOF
+	}
+
+	tok = token{line: l.line, offset: l.pos}
+	c := l.src[l.pos]
+
+	switch {
+	case isSpace(c):
+		tok.kind = tokenSpace
+		for l.pos < len(l.src) && isSpace(l.src[l.pos]) {
+			l.pos++
+		}
+	case c == '-' && l.peek(1) == '-' && l.dashComment(), c == '#' && l.mysql:
+		tok.kind = tokenComment
+		l.lineComment()
+	case c == '/' && l.peek(1) == '*':
+		tok.kind = tokenComment
+		err = l.blockComment()
+	case c == '\'', c == '"' && l.mysql:
+		tok.kind = tokenString
+		err = l.quoted(c, l.mysql)
+	case c == '"':
+		tok.kind = tokenIdent
+		err = l.quoted('"', false)
+	case c == '`' && l.mysql:
+		tok.kind = tokenIdent
+		err = l.quoted('`', false)
+	case (c == 'e' || c == 'E') && l.peek(1) == '\'' && !l.mysql:
+		tok.kind = tokenString
+		l.pos++
+		err = l.quoted('\'', true)
+	case c == '$' && !l.mysql:
+		if tag := l.dollarTag(); tag != "" {
+			tok.kind = tokenString
+			err = l.dollarQuoted(tag)
+		} else {
+			tok.kind = tokenPunct
+			l.pos++
+		}
+	case isWord(c):
+		tok.kind = tokenWord
+		for l.pos < len(l.src) && (isWord(l.src[l.pos]) || l.src[l.pos] == '$') {
+			l.pos++
+		}
+	default:
+		tok.kind = tokenPunct
+		_, size := utf8.DecodeRuneInString(l.src[l.pos:])
+		l.pos += size
+	}
+
+	if err != nil {
+		return token{}, fmt.Errorf("%d: %s", tok.line, err)
+	}
+
+	tok.text = l.src[tok.offset:l.pos]
+	l.line += strings.Count(tok.text, "\n")
+	return tok, nil
+}
+
+// Returns true if the -- at the current position starts a comment. MySQL requires it to
+// be followed by whitespace, e.g. so that 5--1 is not a comment, but migrate directives
+// are always comments since they are not part of the SQL.
+func (l *lexer) dashComment() bool {
+	if !l.mysql || isSpace(l.peek(2)) || l.peek(2) == 0 {
+		return true
+	}
+	line := l.src[l.pos:]
+	if i := strings.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+
+	_, ok := directive(line)
+	return ok
+}
+
+// Consume a line comment up to, but not including, the end of the line.
+func (l *lexer) lineComment() {
+	if i := strings.IndexByte(l.src[l.pos:], '\n'); i >= 0 {
+		l.pos += i
+	} else {
+		l.pos = len(l.src)
+	}
+}
+
+// Returns the byte i positions ahead of the current position or 0 if out of range.
+func (l *lexer) peek(i int) byte {
+	if l.pos+i < len(l.src) {
+		return l.src[l.pos+i]
+	}
+	return 0
+}
+
+// Consume a string literal or identifier delimited by q, where a doubled q is an escaped
+// delimiter. If backslash is true, e.g. for E'\n' strings, backslash escapes are allowed.
+func (l *lexer) quoted(q byte, backslash bool) error {
+	for l.pos++; l.pos < len(l.src); l.pos++ {
+		switch c := l.src[l.pos]; {
+		case backslash && c == '\\':
+			l.pos++
+		case c == q:
+			if l.peek(1) != q {
+				l.pos++
+				return nil
+			}
+			l.pos++
+		}
+	}
+
+	if q == '`' || (q == '"' && !l.mysql) {
+		return errors.New("unterminated quoted identifier")
+	}
+	return errors.New("unterminated quoted string")
+}
+
+// Consume a possibly nested /* */ block comment.
+func (l *lexer) blockComment() error {
+	depth := 0
+	for l.pos < len(l.src) {
+		switch {
+		case l.src[l.pos] == '/' && l.peek(1) == '*':
+			depth++
+			l.pos += 2
+		case l.src[l.pos] == '*' && l.peek(1) == '/':
+			depth--
+			l.pos += 2
+			if depth == 0 {
+				return nil
+			}
+		default:
+			l.pos++
+		}
+	}
+	return errors.New("unterminated block comment")
+}
+
+// Returns the $tag$ that opens a dollar-quoted string at the current position or an
+// empty string if the $ does not start a dollar quote (e.g. it is a $1 parameter).
+func (l *lexer) dollarTag() string {
+	i := l.pos + 1
+	if i < len(l.src) && l.src[i] >= '0' && l.src[i] <= '9' {
+		return ""
+	}
+
+	for i < len(l.src) && isWord(l.src[i]) {
+		i++
+	}
+
+	if i < len(l.src) && l.src[i] == '$' {
+		return l.src[l.pos : i+1]
+	}
+	return ""
+}
+
+// Consume a dollar-quoted string that is opened and closed with the specified tag.
+func (l *lexer) dollarQuoted(tag string) error {
+	i := strings.Index(l.src[l.pos+len(tag):], tag)
+	if i < 0 {
+		return fmt.Errorf("unterminated dollar-quoted string %s", tag)
+	}
+	l.pos += len(tag) + i + len(tag)
+	return nil
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v'
+}
+
+// Unquoted identifiers, keywords and numbers; bytes of multi-byte characters are
+// treated as identifier characters as PostgreSQL does.
+func isWord(c byte) bool {
+	return c == '_' || c >= 0x80 || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
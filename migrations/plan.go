@@ -0,0 +1,121 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// Direction specifies if a migration is applied or rolled back by a migration step.
+type Direction uint8
+
+// Migration step directions
+const (
+	Up Direction = iota + 1
+	Down
+)
+
+func (d Direction) String() string {
+	switch d {
+	case Up:
+		return "up"
+	case Down:
+		return "down"
+	default:
+		return "unknown"
+	}
+}
+
+// Step is a single migration that is applied or rolled back when migrating the
+// database to a target revision.
+type Step struct {
+	Migration
+	Direction Direction
+}
+
+// SQL returns the query that will be executed by the step.
+func (s *Step) SQL() string {
+	if s.Direction == Down {
+		return s.DownSQL()
+	}
+	return s.UpSQL()
+}
+
+// Execute a transactional step inside of the migration transaction.
+func (s *Step) execTx(ctx context.Context, tx *sql.Tx) error {
+	if s.Direction == Down {
+		return s.downTx(ctx, tx)
+	}
+	return s.upTx(ctx, tx)
+}
+
+// Execute a non-transactional step directly on the migration connection.
+func (s *Step) execConn(ctx context.Context, conn *sql.Conn) error {
+	if s.Direction == Down {
+		return s.downConn(ctx, conn)
+	}
+	return s.upConn(ctx, conn)
+}
+
+// Plan computes the steps that Migrate would execute with the default migrator.
+func Plan(r int64, conn *sql.DB) (steps []Step, err error) {
+	return std.Plan(context.Background(), r, conn)
+}
+
+// Plan computes the steps that Migrate(r, conn) would execute, in the order that they
+// would be executed, without changing anything in the database. The migrations table
+// is created and refreshed inside of a transaction that is always rolled back, so the
+// plan for an uninitialized database can be computed as well. On MySQL, which commits
+// DDL statements implicitly, the bookkeeping tables of an uninitialized database are
+// created and kept anyway, as are the checksums of migrations applied before they were
+// recorded.
+func (mg *Migrator) Plan(ctx context.Context, r int64, conn *sql.DB) (steps []Step, err error) {
+	mg.mu.Lock()
+	defer mg.mu.Unlock()
+
+	err = mg.withLock(ctx, conn, func(ctx context.Context, session *sql.Conn) (err error) {
+		var tx *sql.Tx
+		if tx, err = session.BeginTx(ctx, nil); err != nil {
+			return fmt.Errorf("could not begin plan transaction: %s", err)
+		}
+		defer tx.Rollback()
+
+		if err = mg.refreshTx(ctx, tx); err != nil {
+			return err
+		}
+
+		steps = mg.plan(r)
+		return nil
+	})
+	return steps, err
+}
+
+// Compute the steps required to migrate the synchronized migrations to revision r (or
+// to the latest revision if r is negative). Active migrations after the target are
+// rolled back first, from the newest to the oldest, then inactive migrations up to the
+// target are applied from the oldest to the newest. Migration 0 is never included.
+// When migrating to the latest revision, repeatable migrations that are new or have
+// changed are applied last, in order of their names.
+func (mg *Migrator) plan(r int64) (steps []Step) {
+	for i := len(mg.migrations) - 1; i > 0; i-- {
+		if m := mg.migrations[i]; r >= 0 && m.Revision > r && m.Active {
+			steps = append(steps, Step{Migration: m, Direction: Down})
+		}
+	}
+
+	for i := 1; i < len(mg.migrations); i++ {
+		if m := mg.migrations[i]; (r < 0 || m.Revision <= r) && !m.Active {
+			steps = append(steps, Step{Migration: m, Direction: Up})
+		}
+	}
+
+	if r < 0 {
+		for _, m := range mg.repeatables {
+			if m.pending() {
+				steps = append(steps, Step{Migration: m, Direction: Up})
+			}
+		}
+	}
+
+	return steps
+}
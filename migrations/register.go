@@ -0,0 +1,143 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"runtime"
+	"sort"
+)
+
+// Register adds the migration SQL files in the root directory of fsys to the default
+// migrator.
+func Register(fsys fs.FS) (err error) {
+	return std.Register(fsys)
+}
+
+// Register parses the migration SQL files in the root directory of fsys and adds them
+// to the migrations managed by the migrator, including repeatable migrations named
+// R__description.sql. The migrations in this package are registered with the default
+// migrator from an embedded filesystem when the package is initialized; applications can
+// register their own migrations, e.g. from an embed.FS or with os.DirFS, so long as
+// their revisions (and repeatable names) do not collide with any registered migration.
+// Use fs.Sub to register migrations from a subdirectory. Either all of the migrations
+// in fsys are registered or, if any of them cannot be parsed, none of them are.
+func (mg *Migrator) Register(fsys fs.FS) (err error) {
+	mg.mu.Lock()
+	defer mg.mu.Unlock()
+
+	var names []string
+	if names, err = fs.Glob(fsys, "*.sql"); err != nil {
+		return fmt.Errorf("could not list migrations: %s", err)
+	}
+
+	revisions := make(map[int64]string, len(mg.migrations)+len(names))
+	for _, m := range mg.migrations {
+		revisions[m.Revision] = m.filename
+	}
+
+	repeatableNames := make(map[string]string, len(mg.repeatables))
+	for _, m := range mg.repeatables {
+		repeatableNames[m.Name] = m.filename
+	}
+
+	var repeated []Migration
+	added := make([]Migration, 0, len(names))
+	for _, name := range names {
+		var src []byte
+		if src, err = fs.ReadFile(fsys, name); err != nil {
+			return fmt.Errorf("could not read %q: %s", name, err)
+		}
+
+		var m *Migration
+		if m, err = parse(name, src); err != nil {
+			return err
+		}
+
+		if m.repeatable {
+			if other, ok := repeatableNames[m.Name]; ok {
+				return fmt.Errorf("cannot register %s: repeatable migration %q is already registered by %s", name, m.Name, other)
+			}
+
+			repeatableNames[m.Name] = name
+			m.mg = mg
+			repeated = append(repeated, *m)
+			continue
+		}
+
+		if other, ok := revisions[m.Revision]; ok {
+			return fmt.Errorf("cannot register %s: revision %d is already registered by %s", name, m.Revision, other)
+		}
+
+		revisions[m.Revision] = name
+		added = append(added, *m)
+	}
+
+	mg.insert(added...)
+	mg.repeatables = append(mg.repeatables, repeated...)
+	sort.Slice(mg.repeatables, func(i, j int) bool { return mg.repeatables[i].Name < mg.repeatables[j].Name })
+	return nil
+}
+
+// MigrationFunc applies or rolls back a Go migration inside of the migration transaction.
+type MigrationFunc func(ctx context.Context, tx *sql.Tx) error
+
+// RegisterGo adds a migration implemented by Go functions to the default migrator.
+func RegisterGo(revision int64, name string, up, down MigrationFunc) error {
+	return std.registerGo(revision, name, up, down)
+}
+
+// RegisterGo adds a migration implemented by Go functions rather than SQL, e.g. for
+// data backfills that are impractical to write in SQL. Go migrations are interleaved
+// with SQL migrations by revision and have the same bookkeeping in the migrations table;
+// they are always run inside of the migration transaction. The down function may be nil
+// if the migration cannot be rolled back, in which case rolling it back is a no-op.
+// RegisterGo is usually called from an init function.
+func (mg *Migrator) RegisterGo(revision int64, name string, up, down MigrationFunc) error {
+	return mg.registerGo(revision, name, up, down)
+}
+
+// The filename of a Go migration is the file of the caller of RegisterGo, which is two
+// calls up from here whether it was called on a migrator or the default migrator.
+func (mg *Migrator) registerGo(revision int64, name string, up, down MigrationFunc) error {
+	mg.mu.Lock()
+	defer mg.mu.Unlock()
+
+	if up == nil {
+		return fmt.Errorf("cannot register revision %d: go migrations require an up function", revision)
+	}
+
+	for _, m := range mg.migrations {
+		if m.Revision == revision {
+			return fmt.Errorf("cannot register revision %d %q: revision is already registered by %s", revision, name, m.filename)
+		}
+	}
+
+	// Use the file of the caller as the filename for the migration
+	filename := "unknown.go"
+	if _, file, _, ok := runtime.Caller(2); ok {
+		filename = filepath.Base(file)
+	}
+
+	mg.insert(Migration{
+		Revision: revision,
+		Name:     name,
+		filename: filename,
+		upFn:     up,
+		downFn:   down,
+	})
+	return nil
+}
+
+// Add migrations whose revisions have been checked for collisions and keep the
+// migrations sorted by revision.
+func (mg *Migrator) insert(added ...Migration) {
+	for i := range added {
+		added[i].mg = mg
+	}
+
+	mg.migrations = append(mg.migrations, added...)
+	sort.Sort(ByRevision(mg.migrations))
+}
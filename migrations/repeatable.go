@@ -0,0 +1,101 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Repeatables returns the repeatable migrations registered with the default migrator.
+func Repeatables() []Migration {
+	return std.Repeatables()
+}
+
+// Repeatables returns the registered repeatable migrations sorted by name. Repeatable
+// migrations are SQL files named R__description.sql, e.g. for views, functions and
+// triggers that are redefined whenever they change rather than by a new revision. They
+// are re-applied by Migrate, after all of the versioned migrations, whenever their
+// checksum differs from the checksum recorded when they were last applied. Their state is
+// recorded in the repeatable_migrations table rather than the migrations table, which is
+// keyed by revision and whose rows are deactivated by rollbacks, since repeatable
+// migrations have no revision and are never rolled back; Status and the migration
+// history report them along with the versioned migrations.
+func (mg *Migrator) Repeatables() []Migration {
+	mg.mu.RLock()
+	defer mg.mu.RUnlock()
+	return append([]Migration(nil), mg.repeatables...)
+}
+
+// Synchronize the state of the repeatable migrations from the repeatable_migrations
+// table; rows for repeatable migrations that are no longer registered are ignored.
+func (mg *Migrator) refreshRepeatables(ctx context.Context, tx *sql.Tx) (err error) {
+	var rows *sql.Rows
+	if rows, err = tx.QueryContext(ctx, mg.rebind("SELECT name, checksum, applied FROM repeatable_migrations")); err != nil {
+		return fmt.Errorf("could not fetch repeatable migrations: %s", err)
+	}
+	defer rows.Close()
+
+	type state struct {
+		checksum string
+		applied  time.Time
+	}
+
+	applied := make(map[string]state)
+	for rows.Next() {
+		var (
+			name string
+			row  state
+		)
+
+		if err = rows.Scan(&name, &row.checksum, &row.applied); err != nil {
+			return fmt.Errorf("could not scan repeatable migration: %s", err)
+		}
+		applied[name] = row
+	}
+
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("error while reading repeatable migrations: %s", err)
+	}
+
+	for i := range mg.repeatables {
+		row, ok := applied[mg.repeatables[i].Name]
+		mg.repeatables[i].Active = ok
+		mg.repeatables[i].Applied = row.applied
+		mg.repeatables[i].checksum = row.checksum
+		mg.repeatables[i].dbsync = true
+	}
+	return nil
+}
+
+// Record that the repeatable migration has been applied with its current checksum.
+func (m *Migration) markRepeatable(ctx context.Context, tx *sql.Tx) (err error) {
+	now := time.Now().UTC()
+
+	var result sql.Result
+	if result, err = tx.ExecContext(ctx, m.migrator().rebind("UPDATE repeatable_migrations SET filename=$1, checksum=$2, applied=$3 WHERE name=$4"), m.filename, m.Checksum(), now, m.Name); err != nil {
+		return fmt.Errorf("could not update repeatable migration status: %s", err)
+	}
+
+	var n int64
+	if n, err = result.RowsAffected(); err != nil {
+		return fmt.Errorf("could not update repeatable migration status: %s", err)
+	}
+
+	if n == 0 {
+		if _, err = tx.ExecContext(ctx, m.migrator().rebind("INSERT INTO repeatable_migrations (name, filename, checksum, applied) VALUES ($1, $2, $3, $4)"), m.Name, m.filename, m.Checksum(), now); err != nil {
+			return fmt.Errorf("could not insert repeatable migration status: %s", err)
+		}
+	}
+
+	m.Active = true
+	m.Applied = now
+	m.checksum = m.Checksum()
+	return nil
+}
+
+// Returns true if the repeatable migration has never been applied or has changed since
+// it was last applied.
+func (m *Migration) pending() bool {
+	return !m.Active || m.checksum != m.Checksum()
+}
@@ -0,0 +1,106 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// RoundTrip verifies that every migration of the default migrator can be rolled back.
+func RoundTrip(conn *sql.DB) (n int, err error) {
+	return std.RoundTrip(context.Background(), conn)
+}
+
+// RoundTrip verifies that every migration can be rolled back by applying each revision
+// in turn against a scratch database, snapshotting the schema, rolling the revision
+// back, checking that the schema matches the snapshot taken before it was applied, and
+// then re-applying it and checking that the schema matches its snapshot again. This
+// catches down migrations that do not undo their up migration. It can be used in the
+// tests of applications that register their own migrations as well as by db:test.
+//
+// Once every revision has been verified, RoundTrip migrates the database to the latest
+// revision, which also applies the repeatable migrations, leaving the database as
+// Migrate(-1) would. It refuses to run against a database that has any migrations,
+// including repeatable migrations, applied to it. Returns the number of revisions that
+// were verified before any error occurred.
+func (mg *Migrator) RoundTrip(ctx context.Context, conn *sql.DB) (n int, err error) {
+	if err = mg.Refresh(ctx, conn); err != nil {
+		return 0, err
+	}
+
+	mg.mu.Lock()
+	migrations := append([]Migration(nil), mg.migrations...)
+	repeatables := append([]Migration(nil), mg.repeatables...)
+	mg.mu.Unlock()
+
+	for _, m := range migrations[1:] {
+		if m.Active {
+			return 0, fmt.Errorf("round trips require a scratch database but revision %d has been applied", m.Revision)
+		}
+	}
+
+	for _, m := range repeatables {
+		if m.Active {
+			return 0, fmt.Errorf("round trips require a scratch database but %s has been applied", m.filename)
+		}
+	}
+
+	var before, after *Schema
+	if before, err = mg.Inspect(ctx, conn); err != nil {
+		return 0, err
+	}
+
+	for i := 1; i < len(migrations); i++ {
+		m := migrations[i]
+		prev := migrations[i-1].Revision
+
+		if _, err = mg.Migrate(ctx, m.Revision, conn); err != nil {
+			return n, err
+		}
+
+		if after, err = mg.Inspect(ctx, conn); err != nil {
+			return n, err
+		}
+
+		if _, err = mg.Migrate(ctx, prev, conn); err != nil {
+			return n, err
+		}
+
+		if err = mg.compareSnapshots(ctx, before, conn); err != nil {
+			return n, fmt.Errorf("rolling back revision %d (%s) did not restore the schema: %s", m.Revision, m.filename, err)
+		}
+
+		if _, err = mg.Migrate(ctx, m.Revision, conn); err != nil {
+			return n, err
+		}
+
+		if err = mg.compareSnapshots(ctx, after, conn); err != nil {
+			return n, fmt.Errorf("re-applying revision %d (%s) did not produce the same schema: %s", m.Revision, m.filename, err)
+		}
+
+		mg.logger.Info("verified up/down/up round trip of revision %d", m.Revision)
+		before = after
+		n++
+	}
+
+	if _, err = mg.Migrate(ctx, -1, conn); err != nil {
+		return n, err
+	}
+	return n, nil
+}
+
+// Compare the current schema of the database with the expected schema, returning an
+// error that describes the differences if they do not match.
+func (mg *Migrator) compareSnapshots(ctx context.Context, expected *Schema, conn *sql.DB) (err error) {
+	var actual *Schema
+	if actual, err = mg.Inspect(ctx, conn); err != nil {
+		return err
+	}
+
+	if diffs := expected.Diff(actual); len(diffs) > 0 {
+		return errors.New(strings.Join(diffs, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,266 @@
+package migrations
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Schema is a normalized description of the tables of a database, their columns,
+// constraints and indices. It is inspected from the catalog of the database and can be
+// dumped to and parsed from a schema.sql file so that the schema effect of migrations
+// can be reviewed and compared with a live database.
+type Schema struct {
+	Tables map[string]*Table
+}
+
+// Table describes a table in the schema. Columns map the column name to its type and
+// modifiers, constraints map the constraint name to its definition and indices map the
+// index name to the statement that creates it.
+type Table struct {
+	Name        string
+	Columns     map[string]string
+	Constraints map[string]string
+	Indexes     map[string]string
+}
+
+// The tables that manage migrations, which are not part of the application schema.
+var bookkeeping = map[string]bool{
+	"migrations":            true,
+	"migrations_lock":       true,
+	"repeatable_migrations": true,
+	"migration_history":     true,
+}
+
+// Inspect the schema of the database with the dialect of the default migrator.
+func Inspect(conn *sql.DB) (schema *Schema, err error) {
+	return std.Inspect(context.Background(), conn)
+}
+
+// Inspect the schema of the database from its catalog, excluding the tables that are
+// used to manage migrations.
+func (mg *Migrator) Inspect(ctx context.Context, conn *sql.DB) (schema *Schema, err error) {
+	if schema, err = mg.Dialect().Snapshot(ctx, conn); err != nil {
+		return nil, fmt.Errorf("could not inspect schema: %s", err)
+	}
+
+	for name := range bookkeeping {
+		delete(schema.Tables, mg.rename(name))
+	}
+	return schema, nil
+}
+
+// Build a schema from rows of (kind, table, name, definition) where kind is column,
+// constraint or index, which is how the dialects describe their catalogs.
+func scanSchema(ctx context.Context, q Querier, query string) (schema *Schema, err error) {
+	var rows *sql.Rows
+	if rows, err = q.QueryContext(ctx, query); err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	schema = &Schema{Tables: make(map[string]*Table)}
+	for rows.Next() {
+		var kind, table, name, def string
+		if err = rows.Scan(&kind, &table, &name, &def); err != nil {
+			return nil, err
+		}
+
+		if bookkeeping[table] {
+			continue
+		}
+		schema.add(kind, table, name, def)
+	}
+	return schema, rows.Err()
+}
+
+// Add a column, constraint or index to the table, creating the table if necessary.
+func (s *Schema) add(kind, table, name, def string) {
+	t, ok := s.Tables[table]
+	if !ok {
+		t = &Table{Name: table, Columns: make(map[string]string), Constraints: make(map[string]string), Indexes: make(map[string]string)}
+		s.Tables[table] = t
+	}
+
+	def = strings.Join(strings.Fields(def), " ")
+	switch kind {
+	case "column":
+		t.Columns[name] = def
+	case "constraint":
+		t.Constraints[name] = def
+	case "index":
+		t.Indexes[name] = def
+	}
+}
+
+// Dump writes the schema as a normalized SQL file: tables, columns, constraints and
+// indices are sorted by name so that the file only changes when the schema does.
+func (s *Schema) Dump(w io.Writer) (err error) {
+	out := bufio.NewWriter(w)
+	fmt.Fprintln(out, "-- Normalized schema generated by catena db:schema dump, do not edit by hand.")
+
+	for _, name := range sortedKeys(s.Tables) {
+		t := s.Tables[name]
+		fmt.Fprintf(out, "\nCREATE TABLE %s (\n", t.Name)
+
+		columns := sortedKeys(t.Columns)
+		for i, column := range columns {
+			sep := ","
+			if i == len(columns)-1 {
+				sep = ""
+			}
+			fmt.Fprintf(out, "    %s %s%s\n", column, t.Columns[column], sep)
+		}
+		fmt.Fprintln(out, ");")
+
+		for _, constraint := range sortedKeys(t.Constraints) {
+			fmt.Fprintf(out, "ALTER TABLE %s ADD CONSTRAINT %s %s;\n", t.Name, constraint, t.Constraints[constraint])
+		}
+
+		for _, index := range sortedKeys(t.Indexes) {
+			fmt.Fprintf(out, "%s;\n", t.Indexes[index])
+		}
+	}
+
+	return out.Flush()
+}
+
+// ParseSchema reads a schema that was written by Dump.
+func ParseSchema(r io.Reader) (schema *Schema, err error) {
+	schema = &Schema{Tables: make(map[string]*Table)}
+
+	var (
+		table   string // the table that constraints and indices belong to
+		columns bool   // if the lines are the columns of the table
+		lineno  int
+	)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+
+		switch {
+		case line == "" || strings.HasPrefix(line, "--"):
+			continue
+		case columns && line == ");":
+			columns = false
+		case columns:
+			parts := strings.SplitN(strings.TrimSuffix(line, ","), " ", 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("schema:%d: could not parse column", lineno)
+			}
+			schema.add("column", table, parts[0], parts[1])
+		case strings.HasPrefix(line, "CREATE TABLE ") && strings.HasSuffix(line, " ("):
+			table = strings.TrimSuffix(strings.TrimPrefix(line, "CREATE TABLE "), " (")
+			schema.add("", table, "", "")
+			columns = true
+		case strings.HasPrefix(line, "ALTER TABLE "):
+			fields := strings.SplitN(strings.TrimSuffix(line, ";"), " ", 7)
+			if len(fields) != 7 || fields[3] != "ADD" || fields[4] != "CONSTRAINT" {
+				return nil, fmt.Errorf("schema:%d: could not parse constraint", lineno)
+			}
+			schema.add("constraint", fields[2], fields[5], fields[6])
+		case strings.HasPrefix(line, "CREATE ") && table != "":
+			name := indexName(line)
+			if name == "" {
+				return nil, fmt.Errorf("schema:%d: could not parse index", lineno)
+			}
+			schema.add("index", table, name, strings.TrimSuffix(line, ";"))
+		default:
+			return nil, fmt.Errorf("schema:%d: unexpected statement", lineno)
+		}
+	}
+
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read schema: %s", err)
+	}
+	return schema, nil
+}
+
+// Returns the name of the index created by the statement, preserving its case, or an
+// empty string if the statement does not create an index.
+func indexName(stmt string) string {
+	fields := strings.Fields(stmt)
+	i := 1
+	if i < len(fields) && strings.EqualFold(fields[i], "unique") {
+		i++
+	}
+	if i >= len(fields) || !strings.EqualFold(fields[i], "index") {
+		return ""
+	}
+
+	for i++; i < len(fields); i++ {
+		switch strings.ToLower(fields[i]) {
+		case "concurrently", "if", "not", "exists":
+			continue
+		}
+		return strings.Trim(fields[i], "\"`")
+	}
+	return ""
+}
+
+// Diff returns the differences between the expected schema s and the actual schema,
+// e.g. "missing table notes" or "changed column notes.body: expected text, found
+// varchar(255)". An empty diff means the schemas match.
+func (s *Schema) Diff(actual *Schema) (diffs []string) {
+	for _, name := range sortedKeys(s.Tables) {
+		t, ok := actual.Tables[name]
+		if !ok {
+			diffs = append(diffs, fmt.Sprintf("missing table %s", name))
+			continue
+		}
+
+		expected := s.Tables[name]
+		diffs = append(diffs, diffMaps("column", name, expected.Columns, t.Columns)...)
+		diffs = append(diffs, diffMaps("constraint", name, expected.Constraints, t.Constraints)...)
+		diffs = append(diffs, diffMaps("index", name, expected.Indexes, t.Indexes)...)
+	}
+
+	for _, name := range sortedKeys(actual.Tables) {
+		if _, ok := s.Tables[name]; !ok {
+			diffs = append(diffs, fmt.Sprintf("unexpected table %s", name))
+		}
+	}
+	return diffs
+}
+
+// Compare the columns, constraints or indices of a table.
+func diffMaps(kind, table string, expected, actual map[string]string) (diffs []string) {
+	for _, name := range sortedKeys(expected) {
+		def, ok := actual[name]
+		switch {
+		case !ok:
+			diffs = append(diffs, fmt.Sprintf("missing %s %s.%s", kind, table, name))
+		case def != expected[name]:
+			diffs = append(diffs, fmt.Sprintf("changed %s %s.%s: expected %s, found %s", kind, table, name, expected[name], def))
+		}
+	}
+
+	for _, name := range sortedKeys(actual) {
+		if _, ok := expected[name]; !ok {
+			diffs = append(diffs, fmt.Sprintf("unexpected %s %s.%s", kind, table, name))
+		}
+	}
+	return diffs
+}
+
+// Returns the keys of a map sorted alphabetically.
+func sortedKeys(m interface{}) (keys []string) {
+	switch m := m.(type) {
+	case map[string]string:
+		for key := range m {
+			keys = append(keys, key)
+		}
+	case map[string]*Table:
+		for key := range m {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,180 @@
+package migrations
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Squash generates a baseline migration file in out from the migration files in dir of
+// the default migrator.
+func Squash(through int64, dir, out string, remove bool) (path string, replaced []string, err error) {
+	return std.Squash(through, dir, out, remove)
+}
+
+// Squash generates a baseline migration file in the out directory that is equivalent to
+// all of the migrations in dir after revision 0 up to and including revision through
+// and returns the paths of the migration files that it replaces, which are only removed
+// if remove is true. Since the baseline has the same revision as the last of them, it
+// cannot be registered alongside them: if out is empty or dir, remove must be true,
+// otherwise the baseline is written to out for it to be moved into dir once the
+// replaced files are removed. Keep them, e.g. in version control, until every database
+// has been migrated past the squashed range, since a partially migrated database cannot
+// be migrated with the baseline. The baseline has the revision through and the
+// "-- migrate: squashed" directive; its up section applies the statements of every
+// squashed migration in order and its down section rolls them back in reverse order,
+// including any dialect specific sections. Databases that were migrated at or beyond
+// the squashed revision are unaffected, while new databases only apply the baseline.
+// Databases that are partially migrated through the squashed revisions must be
+// migrated past them with a version of catena from before the squash.
+//
+// Go migrations cannot be squashed since they have no SQL. If any of the squashed
+// migrations must be run outside of a transaction then so must the baseline.
+func (mg *Migrator) Squash(through int64, dir, out string, remove bool) (path string, replaced []string, err error) {
+	mg.mu.Lock()
+	defer mg.mu.Unlock()
+
+	if through <= 0 {
+		return "", nil, fmt.Errorf("cannot squash through revision %d", through)
+	}
+
+	if _, err = mg.revision(through); err != nil {
+		return "", nil, err
+	}
+
+	if out == "" {
+		out = dir
+	}
+
+	var inplace bool
+	if inplace, err = sameDir(dir, out); err != nil {
+		return "", nil, err
+	}
+
+	if inplace && !remove {
+		return "", nil, fmt.Errorf("cannot write the baseline to %s alongside the migrations that it replaces, which have the same revision: remove them or write the baseline to another directory", dir)
+	}
+
+	var squashed []Migration
+	for _, m := range mg.migrations[1:] {
+		if m.Revision > through {
+			break
+		}
+
+		if m.IsGo() {
+			return "", nil, fmt.Errorf("cannot squash go migration revision %d (%s)", m.Revision, m.filename)
+		}
+
+		filename := filepath.Join(dir, m.filename)
+		if _, err = os.Stat(filename); err != nil {
+			return "", nil, fmt.Errorf("cannot squash revision %d: %s is not in %s", m.Revision, m.filename, dir)
+		}
+
+		squashed = append(squashed, m)
+		replaced = append(replaced, filename)
+	}
+
+	builder := &strings.Builder{}
+	fmt.Fprintf(builder, "-- Baseline generated on %s by squashing revisions %d through %d\n", time.Now().Format("2006-01-02 15:04"), squashed[0].Revision, through)
+	fmt.Fprintln(builder, "-- migrate: squashed")
+	for _, m := range squashed {
+		if m.notx {
+			fmt.Fprintln(builder, "-- migrate: no-transaction")
+			break
+		}
+	}
+
+	writeSquashed(builder, "", squashed)
+
+	// Dialect specific sections are generated for every dialect used by a migration
+	dialects := make(map[string]struct{})
+	for _, m := range squashed {
+		for name := range m.dialects {
+			dialects[name] = struct{}{}
+		}
+	}
+
+	names := make([]string, 0, len(dialects))
+	for name := range dialects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		writeSquashed(builder, name, squashed)
+	}
+
+	path = filepath.Join(out, fmt.Sprintf("%04d_baseline.sql", through))
+	if err = os.WriteFile(path, []byte(builder.String()), 0644); err != nil {
+		return "", nil, fmt.Errorf("could not write baseline: %s", err)
+	}
+
+	if !remove {
+		return path, replaced, nil
+	}
+
+	for _, filename := range replaced {
+		if filename == path {
+			continue
+		}
+
+		if err = os.Remove(filename); err != nil {
+			return path, replaced, fmt.Errorf("could not remove squashed migration: %s", err)
+		}
+	}
+
+	return path, replaced, nil
+}
+
+// Returns true if the paths refer to the same directory.
+func sameDir(a, b string) (same bool, err error) {
+	if a, err = filepath.Abs(a); err != nil {
+		return false, fmt.Errorf("could not resolve %s: %s", a, err)
+	}
+	if b, err = filepath.Abs(b); err != nil {
+		return false, fmt.Errorf("could not resolve %s: %s", b, err)
+	}
+	return a == b, nil
+}
+
+// Write the up and down sections of the baseline for the named dialect, or the generic
+// sections if name is empty.
+func writeSquashed(builder *strings.Builder, name string, squashed []Migration) {
+	directive := func(direction Direction) string {
+		if name == "" {
+			return fmt.Sprintf("-- migrate: %s", direction)
+		}
+		return fmt.Sprintf("-- migrate: %s %s", direction, name)
+	}
+
+	fmt.Fprintf(builder, "\n%s\n", directive(Up))
+	for _, m := range squashed {
+		writeStatements(builder, m, m.statementsFor(name, Up))
+	}
+
+	fmt.Fprintf(builder, "\n%s\n", directive(Down))
+	for i := len(squashed) - 1; i >= 0; i-- {
+		writeStatements(builder, squashed[i], squashed[i].statementsFor(name, Down))
+	}
+}
+
+// Write the statements of a squashed migration, ensuring each ends with a semicolon so
+// that it cannot run into the statements of the next migration. The semicolon is added
+// on its own line in case the statement ends with a comment.
+func writeStatements(builder *strings.Builder, m Migration, stmts []statement) {
+	if len(stmts) == 0 {
+		return
+	}
+
+	fmt.Fprintf(builder, "\n-- revision %d (%s)\n", m.Revision, filepath.Base(m.filename))
+	for _, stmt := range stmts {
+		builder.WriteString(stmt.sql)
+		if !strings.HasSuffix(stmt.sql, ";") {
+			builder.WriteString("\n;")
+		}
+		builder.WriteByte('\n')
+	}
+}
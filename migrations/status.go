@@ -0,0 +1,244 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// State describes a migration relative to the database it is compared to.
+type State uint8
+
+const (
+	Pending        State = iota // the migration has not been applied, or a repeatable migration has changed
+	Applied                     // the migration has been applied
+	Modified                    // the migration has been applied but its SQL has changed since
+	MissingLocally              // the migration has been applied but is not registered
+)
+
+var stateNames = [...]string{"pending", "applied", "modified", "missing-locally"}
+
+func (s State) String() string {
+	if int(s) < len(stateNames) {
+		return stateNames[s]
+	}
+	return "unknown"
+}
+
+// MarshalText encodes the state by its name so that it is readable in JSON and YAML.
+func (s State) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// MigrationStatus describes a registered or database-known migration: whether it has
+// been applied, when it was applied and how long the most recent successful application
+// took according to the migration history.
+type MigrationStatus struct {
+	Revision   int64
+	Name       string
+	Repeatable bool
+	State      State
+	Applied    time.Time
+	Duration   time.Duration
+}
+
+// Status returns the status of the migrations of the default migrator.
+func Status(conn *sql.DB) (statuses []MigrationStatus, err error) {
+	return std.Status(context.Background(), conn)
+}
+
+// Status returns the status of every registered migration and of every migration the
+// database knows about that is not registered, sorted by revision and followed by the
+// repeatable migrations sorted by name. Migration 0 is not included. Unlike Refresh,
+// migrations that are missing locally or out of order are reported rather than returned
+// as errors, and the database is not changed, so the status of an uninitialized database
+// can be listed as well. The bookkeeping tables are created in a transaction that is
+// rolled back, except on MySQL, which commits DDL statements implicitly, so they are
+// created and kept there.
+func (mg *Migrator) Status(ctx context.Context, conn *sql.DB) (statuses []MigrationStatus, err error) {
+	mg.mu.Lock()
+	defer mg.mu.Unlock()
+
+	err = mg.withLock(ctx, conn, func(ctx context.Context, session *sql.Conn) (err error) {
+		var tx *sql.Tx
+		if tx, err = session.BeginTx(ctx, nil); err != nil {
+			return fmt.Errorf("could not begin status transaction: %s", err)
+		}
+		defer tx.Rollback()
+
+		// the migration schema is created so it can be queried, then rolled back
+		if err = mg.migrations[0].upTx(ctx, tx); err != nil {
+			return err
+		}
+
+		statuses, err = mg.statusTx(ctx, tx)
+		return err
+	})
+	return statuses, err
+}
+
+func (mg *Migrator) statusTx(ctx context.Context, tx *sql.Tx) (statuses []MigrationStatus, err error) {
+	var durations map[string]time.Duration
+	if durations, err = mg.appliedDurations(ctx, tx); err != nil {
+		return nil, err
+	}
+
+	local := make(map[int64]*Migration, len(mg.migrations))
+	for j := 1; j < len(mg.migrations); j++ {
+		local[mg.migrations[j].Revision] = &mg.migrations[j]
+	}
+
+	var rows *sql.Rows
+	if rows, err = tx.QueryContext(ctx, mg.rebind("SELECT revision, name, active, applied, checksum FROM migrations ORDER BY revision")); err != nil {
+		return nil, fmt.Errorf("could not fetch migrations: %s", err)
+	}
+	defer rows.Close()
+
+	stored := make(map[int64]bool)
+	for rows.Next() {
+		var (
+			status   MigrationStatus
+			active   bool
+			applied  sql.NullTime
+			checksum sql.NullString
+		)
+
+		if err = rows.Scan(&status.Revision, &status.Name, &active, &applied, &checksum); err != nil {
+			return nil, fmt.Errorf("could not scan migration: %s", err)
+		}
+
+		if status.Revision == 0 {
+			continue
+		}
+		stored[status.Revision] = true
+
+		if !active {
+			if m, ok := local[status.Revision]; ok {
+				status.Name = m.Name
+				statuses = append(statuses, status)
+			}
+			continue
+		}
+
+		status.State, status.Applied = Applied, applied.Time
+		status.Duration = durations[fmt.Sprintf("%d", status.Revision)]
+
+		m, ok := local[status.Revision]
+		switch {
+		case ok && m.squashed && m.Name != status.Name:
+			// a baseline that is applied as the migration it replaced is not modified
+			status.Name = m.Name
+		case ok:
+			if checksum.String != "" && !m.IsGo() && checksum.String != m.Checksum() {
+				status.State = Modified
+			}
+		default:
+			// revisions that were squashed into a local baseline are no longer tracked
+			if k := sort.Search(len(mg.migrations), func(k int) bool { return mg.migrations[k].Revision > status.Revision }); k < len(mg.migrations) && mg.migrations[k].squashed {
+				continue
+			}
+			status.State = MissingLocally
+		}
+		statuses = append(statuses, status)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error while reading migrations: %s", err)
+	}
+	rows.Close()
+
+	for j := 1; j < len(mg.migrations); j++ {
+		if !stored[mg.migrations[j].Revision] {
+			statuses = append(statuses, MigrationStatus{Revision: mg.migrations[j].Revision, Name: mg.migrations[j].Name})
+		}
+	}
+	sort.SliceStable(statuses, func(i, j int) bool { return statuses[i].Revision < statuses[j].Revision })
+
+	var repeatable []MigrationStatus
+	if repeatable, err = mg.repeatableStatuses(ctx, tx, durations); err != nil {
+		return nil, err
+	}
+	return append(statuses, repeatable...), nil
+}
+
+// Returns the status of the registered repeatable migrations and of the repeatable
+// migrations that were applied but are no longer registered, sorted by name.
+func (mg *Migrator) repeatableStatuses(ctx context.Context, tx *sql.Tx, durations map[string]time.Duration) (statuses []MigrationStatus, err error) {
+	local := make(map[string]*Migration, len(mg.repeatables))
+	for i := range mg.repeatables {
+		local[mg.repeatables[i].Name] = &mg.repeatables[i]
+	}
+
+	var rows *sql.Rows
+	if rows, err = tx.QueryContext(ctx, mg.rebind("SELECT name, checksum, applied FROM repeatable_migrations ORDER BY name")); err != nil {
+		return nil, fmt.Errorf("could not fetch repeatable migrations: %s", err)
+	}
+	defer rows.Close()
+
+	stored := make(map[string]bool)
+	for rows.Next() {
+		var checksum string
+		status := MigrationStatus{Repeatable: true, State: Applied}
+		if err = rows.Scan(&status.Name, &checksum, &status.Applied); err != nil {
+			return nil, fmt.Errorf("could not scan repeatable migration: %s", err)
+		}
+
+		stored[status.Name] = true
+		status.Duration = durations["R__"+status.Name]
+
+		if m, ok := local[status.Name]; !ok {
+			status.State = MissingLocally
+		} else if checksum != m.Checksum() {
+			status.State = Pending
+		}
+		statuses = append(statuses, status)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error while reading repeatable migrations: %s", err)
+	}
+
+	for _, m := range mg.repeatables {
+		if !stored[m.Name] {
+			statuses = append(statuses, MigrationStatus{Name: m.Name, Repeatable: true})
+		}
+	}
+	sort.SliceStable(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses, nil
+}
+
+// Returns the duration of the most recent successful application of each migration from
+// the migration history, keyed by revision or, for repeatable migrations, by R__name.
+func (mg *Migrator) appliedDurations(ctx context.Context, tx *sql.Tx) (durations map[string]time.Duration, err error) {
+	var rows *sql.Rows
+	if rows, err = tx.QueryContext(ctx, mg.rebind("SELECT revision, name, duration_ms FROM migration_history WHERE direction=$1 AND success=$2 ORDER BY id"), Up.String(), true); err != nil {
+		return nil, fmt.Errorf("could not query migration history: %s", err)
+	}
+	defer rows.Close()
+
+	durations = make(map[string]time.Duration)
+	for rows.Next() {
+		var (
+			revision sql.NullInt64
+			name     string
+			duration int64
+		)
+
+		if err = rows.Scan(&revision, &name, &duration); err != nil {
+			return nil, fmt.Errorf("could not scan migration history: %s", err)
+		}
+
+		key := "R__" + name
+		if revision.Valid {
+			key = fmt.Sprintf("%d", revision.Int64)
+		}
+		durations[key] = time.Duration(duration) * time.Millisecond
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("could not read migration history: %s", err)
+	}
+	return durations, nil
+}
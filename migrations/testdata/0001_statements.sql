@@ -0,0 +1,21 @@
+-- Statements that cannot be split on lines or semicolons alone.
+-- migrate: up
+
+CREATE TABLE notes (
+    id serial PRIMARY KEY,
+    -- comments inside of a statement are kept
+    body text NOT NULL DEFAULT '-- not a comment; not the end'
+);
+
+CREATE FUNCTION touch() RETURNS trigger AS $$
+BEGIN
+    NEW.body := NEW.body || ';';
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+INSERT INTO notes (body) VALUES (E'it\'s; escaped'), ('it''s; doubled');;
+
+-- migrate: down
+DROP FUNCTION touch(); /* a trailing; block comment */
+DROP TABLE notes
@@ -0,0 +1,6 @@
+-- migrate: up
+CREATE FUNCTION broken() RETURNS integer AS $body$
+BEGIN
+    RETURN 1;
+END;
+$$ LANGUAGE plpgsql;
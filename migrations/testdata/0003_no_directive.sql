@@ -0,0 +1,3 @@
+-- this migration is missing its directives
+
+CREATE TABLE orphans (id integer);
@@ -0,0 +1,6 @@
+-- migrate: no-transaction
+-- migrate: up
+CREATE INDEX CONCURRENTLY IF NOT EXISTS notes_body_idx ON notes (body);
+
+-- migrate: down
+DROP INDEX CONCURRENTLY IF EXISTS notes_body_idx;
@@ -0,0 +1,8 @@
+-- migrate: up
+CREATE TABLE notes (id serial PRIMARY KEY, body text NOT NULL) WITHOUT OIDS;
+
+-- migrate: up sqlite
+CREATE TABLE notes (id integer PRIMARY KEY AUTOINCREMENT, body text NOT NULL);
+
+-- migrate: down
+DROP TABLE notes;
@@ -0,0 +1,13 @@
+-- migrate: up
+CREATE TABLE tags (id integer PRIMARY KEY);
+CREATE INDEX tags_id ON tags (id);
+CREATE INDEX edges_created ON public.edges (created);
+CREATE UNIQUE INDEX CONCURRENTLY nodes_handle ON nodes (handle);
+CREATE INDEX nodes_name ON nodes (name);
+ALTER TABLE nodes ADD COLUMN bio text NOT NULL, ADD COLUMN verified boolean NOT NULL DEFAULT false;
+ALTER TABLE nodes ALTER COLUMN followers TYPE bigint, DROP CONSTRAINT nodes_check;
+-- lint: allow drop-column
+ALTER TABLE nodes DROP COLUMN legacy;
+ALTER TABLE edges DROP COLUMN weight;
+DROP TABLE IF EXISTS scratch /* lint: allow drop-table */;
+DROP TABLE old_edges;
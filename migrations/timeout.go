@@ -0,0 +1,98 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// TimeoutError is returned by Migrate when a statement of a migration was canceled
+// because it waited longer than its lock timeout or ran longer than its statement
+// timeout. The migration is not applied, so it can safely be retried, e.g. when the
+// database is less busy.
+type TimeoutError struct {
+	Migration        string        // the migration that timed out, e.g. revision 42
+	LockTimeout      time.Duration // the lock timeout of the migration
+	StatementTimeout time.Duration // the statement timeout of the migration
+	Err              error         // the error returned by the database
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s timed out (lock_timeout=%s, statement_timeout=%s): %s", e.Migration, formatTimeout(e.LockTimeout), formatTimeout(e.StatementTimeout), e.Err)
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// Timeouts returns the lock and statement timeouts of the migration, which are the
+// defaults of its migrator unless they are specified by a directive.
+func (m *Migration) Timeouts() (lock, statement time.Duration) {
+	mg := m.migrator()
+	mg.mu.RLock()
+	defer mg.mu.RUnlock()
+	return m.timeouts()
+}
+
+// Returns the timeouts of the migration; the caller must hold the migrator's lock.
+func (m *Migration) timeouts() (lock, statement time.Duration) {
+	opts := m.migrator().options()
+	lock, statement = opts.LockTimeout, opts.StatementTimeout
+	if timeout, ok := m.limits[settingLockTimeout]; ok {
+		lock = timeout
+	}
+	if timeout, ok := m.limits[settingStatementTimeout]; ok {
+		statement = timeout
+	}
+	return lock, statement
+}
+
+// Run fn with the timeouts of the migration applied by the dialect. If local is true
+// the timeouts are set for the current transaction, otherwise they are set for the
+// session. Either way they are reset after fn returns so that they do not apply to the
+// next migration in the transaction or to the next user of the connection, even if fn
+// fails, since dialects without transaction scoped settings set them on the session.
+func (m *Migration) withTimeouts(ctx context.Context, q Querier, local bool, fn func() error) (err error) {
+	lock, statement := m.timeouts()
+	set, reset := m.migrator().dialect.Timeouts(lock, statement, local)
+
+	for _, stmt := range set {
+		if _, err = q.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("could not set timeouts: %s", err)
+		}
+	}
+
+	if err = fn(); err != nil {
+		// best effort, since a failed transaction is rolled back along with its settings
+		for _, stmt := range reset {
+			q.ExecContext(ctx, stmt)
+		}
+		return err
+	}
+
+	for _, stmt := range reset {
+		if _, err = q.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("could not reset timeouts: %s", err)
+		}
+	}
+	return nil
+}
+
+// Returns a TimeoutError if the error returned by executing the step was caused by a
+// lock or statement timeout, otherwise the error is returned unchanged.
+func (s *Step) timedOut(err error) error {
+	if err == nil || !s.migrator().dialect.TimedOut(err) {
+		return err
+	}
+
+	lock, statement := s.timeouts()
+	return &TimeoutError{Migration: s.ref(), LockTimeout: lock, StatementTimeout: statement, Err: err}
+}
+
+// Format a timeout for error messages, where zero means the database's own timeout.
+func formatTimeout(timeout time.Duration) string {
+	if timeout == 0 {
+		return "default"
+	}
+	return timeout.String()
+}
@@ -0,0 +1,169 @@
+package seed
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/bbengfort/catena/migrations"
+	"gopkg.in/yaml.v2"
+)
+
+// Fixture is a set of rows to upsert into a table. Rows are matched to existing rows by
+// their natural key columns, e.g. the username of a user, so that rows which already
+// exist are updated rather than inserted again. A fixture file contains either a single
+// fixture or a list of fixtures, for example:
+//
+//	# seeds/02_users.yml
+//	- table: users
+//	  key: [username]
+//	  rows:
+//	    - {username: alice, name: Alice}
+//	    - {username: bob, name: Bob}
+type Fixture struct {
+	Table string                   `yaml:"table"`
+	Key   []string                 `yaml:"key"`
+	Rows  []map[string]interface{} `yaml:"rows"`
+}
+
+// ParseFixtures parses a YAML or JSON fixture file, which contains either a single
+// fixture or a list of fixtures.
+func ParseFixtures(data []byte) (fixtures []Fixture, err error) {
+	if err = yaml.UnmarshalStrict(data, &fixtures); err != nil {
+		var fixture Fixture
+		if yaml.UnmarshalStrict(data, &fixture) != nil {
+			return nil, fmt.Errorf("could not parse fixtures: %s", err)
+		}
+		fixtures = []Fixture{fixture}
+	}
+
+	for _, fixture := range fixtures {
+		if err = fixture.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	return fixtures, nil
+}
+
+// Identifiers are interpolated into queries so they must be plain, optionally schema
+// qualified names.
+var identifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+// Validate that the fixture names a table and its natural key and that every row has a
+// value for each key column.
+func (f Fixture) Validate() error {
+	if f.Table == "" {
+		return errors.New("fixture is missing a table")
+	}
+	if !identifier.MatchString(f.Table) {
+		return fmt.Errorf("%q is not a valid table name", f.Table)
+	}
+
+	if len(f.Key) == 0 {
+		return fmt.Errorf("fixture for %s is missing its natural key", f.Table)
+	}
+
+	for i, row := range f.Rows {
+		for _, column := range f.Key {
+			if value, ok := row[column]; !ok || value == nil {
+				return fmt.Errorf("row %d of %s is missing natural key column %q", i+1, f.Table, column)
+			}
+		}
+
+		for column, value := range row {
+			if !identifier.MatchString(column) {
+				return fmt.Errorf("%q is not a valid column name", column)
+			}
+
+			switch value.(type) {
+			case map[interface{}]interface{}, map[string]interface{}, []interface{}:
+				return fmt.Errorf("row %d of %s has a nested value for column %q", i+1, f.Table, column)
+			}
+		}
+	}
+	return nil
+}
+
+// Upsert each of the rows of the fixture in the transaction.
+func (f Fixture) load(ctx context.Context, tx *sql.Tx, d migrations.Dialect) (err error) {
+	for i, row := range f.Rows {
+		if _, err = upsert(ctx, tx, d, f.Table, f.Key, row); err != nil {
+			return fmt.Errorf("could not upsert row %d of %s: %s", i+1, f.Table, err)
+		}
+	}
+	return nil
+}
+
+// Update the rows of the table that match the natural key of the row, or insert the row
+// if there are none. Existing rows are counted first rather than relying on the number
+// of rows affected by the update, which MySQL reports as zero if nothing changed.
+// Returns true if the row was inserted.
+func upsert(ctx context.Context, q migrations.Querier, d migrations.Dialect, table string, key []string, row map[string]interface{}) (inserted bool, err error) {
+	iskey := make(map[string]bool, len(key))
+	keyArgs := make([]interface{}, len(key))
+	for i, column := range key {
+		iskey[column] = true
+		keyArgs[i] = row[column]
+	}
+
+	columns := make([]string, 0, len(row))
+	for column := range row {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+
+	var count int
+	query := fmt.Sprintf("SELECT count(*) FROM %s WHERE %s", table, conditions(d, key, 0))
+	if err = q.QueryRowContext(ctx, query, keyArgs...).Scan(&count); err != nil {
+		return false, err
+	}
+
+	if count > 0 {
+		var (
+			values []string
+			args   []interface{}
+		)
+
+		for _, column := range columns {
+			if !iskey[column] {
+				args = append(args, row[column])
+				values = append(values, fmt.Sprintf("%s = %s", column, d.Placeholder(len(args))))
+			}
+		}
+
+		if len(values) > 0 {
+			query = fmt.Sprintf("UPDATE %s SET %s WHERE %s", table, strings.Join(values, ", "), conditions(d, key, len(args)))
+			if _, err = q.ExecContext(ctx, query, append(args, keyArgs...)...); err != nil {
+				return false, err
+			}
+		}
+		return false, nil
+	}
+
+	params := make([]string, len(columns))
+	args := make([]interface{}, len(columns))
+	for i, column := range columns {
+		params[i] = d.Placeholder(i + 1)
+		args[i] = row[column]
+	}
+
+	query = fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", table, strings.Join(columns, ", "), strings.Join(params, ", "))
+	if _, err = q.ExecContext(ctx, query, args...); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Returns the conditions that match the key columns, numbering their placeholders from
+// after the specified number of preceding parameters.
+func conditions(d migrations.Dialect, key []string, offset int) string {
+	conds := make([]string, len(key))
+	for i, column := range key {
+		conds[i] = fmt.Sprintf("%s = %s", column, d.Placeholder(offset+i+1))
+	}
+	return strings.Join(conds, " AND ")
+}
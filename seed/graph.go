@@ -0,0 +1,346 @@
+package seed
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+
+	"github.com/bbengfort/catena/migrations"
+)
+
+// Edge is a directed edge of a generated graph between nodes identified by their index,
+// e.g. the source follows the target.
+type Edge struct {
+	Source int
+	Target int
+}
+
+// ErdosRenyi generates a random directed graph of n nodes where each of the n(n-1)
+// possible edges exists independently with probability p. The gaps between edges are
+// sampled from a geometric distribution so large sparse graphs are generated in time
+// proportional to the number of edges rather than the number of possible edges.
+func ErdosRenyi(n int, p float64, rng *rand.Rand) (edges []Edge) {
+	if n < 2 || p <= 0 {
+		return nil
+	}
+
+	// the possible edges are indexed by source*(n-1) + target, skipping self loops
+	total := float64(n) * float64(n-1)
+	edge := func(k int) Edge {
+		source, target := k/(n-1), k%(n-1)
+		if target >= source {
+			target++
+		}
+		return Edge{Source: source, Target: target}
+	}
+
+	if p >= 1 {
+		for k := 0; k < int(total); k++ {
+			edges = append(edges, edge(k))
+		}
+		return edges
+	}
+
+	lp := math.Log(1 - p)
+	for k := -1.0; ; {
+		k += 1 + math.Floor(math.Log(1-rng.Float64())/lp)
+		if k >= total {
+			return edges
+		}
+		edges = append(edges, edge(int(k)))
+	}
+}
+
+// BarabasiAlbert generates a scale-free directed graph of n nodes by preferential
+// attachment: each node after the first m follows m distinct earlier nodes, chosen with
+// probability proportional to their degree, so a few nodes become hubs with many
+// followers as in real social graphs. The graph has m(n-m) edges.
+func BarabasiAlbert(n, m int, rng *rand.Rand) (edges []Edge) {
+	if m < 1 || n <= m {
+		return nil
+	}
+
+	// each node appears once for every edge it is part of, so sampling uniformly from
+	// repeated samples nodes in proportion to their degree
+	repeated := make([]int, 0, 2*m*(n-m))
+	targets := make([]int, m)
+	for i := range targets {
+		targets[i] = i
+	}
+
+	edges = make([]Edge, 0, m*(n-m))
+	for source := m; source < n; source++ {
+		for _, target := range targets {
+			edges = append(edges, Edge{Source: source, Target: target})
+			repeated = append(repeated, target, source)
+		}
+
+		chosen := make(map[int]bool, m)
+		targets = make([]int, 0, m)
+		for len(targets) < m {
+			target := repeated[rng.Intn(len(repeated))]
+			if !chosen[target] {
+				chosen[target] = true
+				targets = append(targets, target)
+			}
+		}
+	}
+	return edges
+}
+
+// GraphTables maps the nodes and edges of a generated or imported graph onto the tables
+// of the schema, e.g. users and the follows between them.
+type GraphTables struct {
+	Nodes   string            // the table of nodes, e.g. users
+	Key     string            // the natural key column of nodes, e.g. username
+	ID      string            // the column of nodes referenced by edges; the key if empty
+	Columns map[string]string // other node columns, formatted with the key, e.g. "%s@example.com"
+	Prefix  string            // the prefix of generated keys, e.g. user gives user1, user2, ...
+	Edges   string            // the table of edges, e.g. follows
+	Source  string            // the column of edges that references the source node
+	Target  string            // the column of edges that references the target node
+}
+
+// Validate that the tables and columns of the mapping are specified.
+func (g GraphTables) Validate() error {
+	for _, name := range []string{g.Nodes, g.Key, g.Edges, g.Source, g.Target} {
+		if name == "" {
+			return errors.New("graph tables must specify the nodes, key, edges, source and target")
+		}
+		if !identifier.MatchString(name) {
+			return fmt.Errorf("%q is not a valid table or column name", name)
+		}
+	}
+
+	if g.ID != "" && !identifier.MatchString(g.ID) {
+		return fmt.Errorf("%q is not a valid column name", g.ID)
+	}
+
+	for column := range g.Columns {
+		if !identifier.MatchString(column) {
+			return fmt.Errorf("%q is not a valid column name", column)
+		}
+	}
+	return nil
+}
+
+// LoadGraph inserts n generated nodes and the edges between them in a single
+// transaction. Nodes are identified by their generated key and edges by their source and
+// target, and those that already exist are left unchanged, so loading the same graph
+// again leaves the database unchanged. On Postgres the nodes and edges are copied into
+// temporary staging tables with COPY and inserted with a set-based statement as by
+// ImportGraph, other dialects insert them in batches of rows. Returns the number of
+// nodes and edges that were inserted.
+func LoadGraph(conn *sql.DB, d migrations.Dialect, tables GraphTables, n int, edges []Edge) (nodes, inserted int, err error) {
+	if err = tables.Validate(); err != nil {
+		return 0, 0, err
+	}
+
+	ctx := context.Background()
+	var tx *sql.Tx
+	if tx, err = conn.BeginTx(ctx, nil); err != nil {
+		return 0, 0, fmt.Errorf("could not begin transaction: %s", err)
+	}
+	defer tx.Rollback()
+
+	columns := []string{tables.Key}
+	for column := range tables.Columns {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns[1:])
+
+	keys := make([]string, n)
+	rows := make([][]interface{}, n)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("%s%d", tables.Prefix, i+1)
+		rows[i] = []interface{}{keys[i]}
+		for _, column := range columns[1:] {
+			rows[i] = append(rows[i], fmt.Sprintf(tables.Columns[column], keys[i]))
+		}
+	}
+
+	// edges are only inserted once even if they are generated more than once
+	seen := make(map[Edge]bool, len(edges))
+	unique := make([]Edge, 0, len(edges))
+	for _, edge := range edges {
+		if !seen[edge] {
+			seen[edge] = true
+			unique = append(unique, edge)
+		}
+	}
+
+	if d == migrations.Postgres {
+		nodes, inserted, err = copyGraph(ctx, tx, tables, columns, rows, keys, unique)
+	} else {
+		nodes, inserted, err = insertGraph(ctx, tx, d, tables, columns, rows, keys, unique)
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, 0, fmt.Errorf("could not commit graph: %s", err)
+	}
+
+	logger.Info("loaded graph of %d nodes and %d edges into %s and %s", n, len(edges), tables.Nodes, tables.Edges)
+	return nodes, inserted, nil
+}
+
+// Copy the nodes and edges into staging tables and insert the ones that do not exist,
+// resolving the keys of the edges to the ids of their nodes in the database.
+func copyGraph(ctx context.Context, tx *sql.Tx, tables GraphTables, columns []string, rows [][]interface{}, keys []string, edges []Edge) (nodes, inserted int, err error) {
+	imp := &importer{ctx: ctx, tx: tx, d: migrations.Postgres, tables: tables, rejects: csv.NewWriter(ioutil.Discard)}
+
+	var s sink
+	if s, err = imp.copyNodes(columns, false); err != nil {
+		return 0, 0, err
+	}
+
+	for i, values := range rows {
+		if err = s.write(row{n: i + 1, values: values}); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	if nodes, err = s.finish(); err != nil {
+		return 0, 0, err
+	}
+
+	if s, err = imp.copyEdges("", []string{tables.Source, tables.Target}); err != nil {
+		return 0, 0, err
+	}
+
+	for i, edge := range edges {
+		if err = s.write(row{n: i + 1, values: []interface{}{keys[edge.Source], keys[edge.Target]}}); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	if inserted, err = s.finish(); err != nil {
+		return 0, 0, err
+	}
+	return nodes, inserted, nil
+}
+
+// Insert the nodes and edges that do not exist in batches of rows.
+func insertGraph(ctx context.Context, tx *sql.Tx, d migrations.Dialect, tables GraphTables, columns []string, rows [][]interface{}, keys []string, edges []Edge) (nodes, inserted int, err error) {
+	if nodes, err = insertMissing(ctx, tx, d, tables.Nodes, columns, []string{tables.Key}, rows); err != nil {
+		return 0, 0, err
+	}
+
+	// edges reference the nodes by their key unless they reference a generated id
+	refs := keys
+	if tables.ID != "" {
+		if refs, err = nodeIDs(ctx, tx, tables, keys); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	key := []string{tables.Source, tables.Target}
+	rows = make([][]interface{}, len(edges))
+	for i, edge := range edges {
+		rows[i] = []interface{}{refs[edge.Source], refs[edge.Target]}
+	}
+
+	if inserted, err = insertMissing(ctx, tx, d, tables.Edges, key, key, rows); err != nil {
+		return 0, 0, err
+	}
+	return nodes, inserted, nil
+}
+
+// The maximum number of rows and of parameters of a batch inserted by insertMissing,
+// which are within the limits of SQLite on compound selects and bind parameters.
+const (
+	batchRows   = 400
+	batchParams = 900
+)
+
+// Insert the rows of values of the columns into the table in batches, skipping the rows
+// whose key matches a row that is already in the table, and return the number of rows
+// that were inserted. The rows of a batch are selected with UNION ALL rather than from a
+// VALUES list since SQLite and MySQL name the columns of VALUES lists differently.
+func insertMissing(ctx context.Context, tx *sql.Tx, d migrations.Dialect, table string, columns, key []string, rows [][]interface{}) (inserted int, err error) {
+	size := batchRows
+	if size*len(columns) > batchParams {
+		size = batchParams / len(columns)
+	}
+
+	match := make([]string, len(key))
+	for i, column := range key {
+		match[i] = fmt.Sprintf("t.%s = v.%[1]s", column)
+	}
+
+	for start := 0; start < len(rows); start += size {
+		end := start + size
+		if end > len(rows) {
+			end = len(rows)
+		}
+
+		selects := make([]string, 0, end-start)
+		args := make([]interface{}, 0, (end-start)*len(columns))
+		for _, values := range rows[start:end] {
+			params := make([]string, len(values))
+			for i, value := range values {
+				args = append(args, value)
+				params[i] = d.Placeholder(len(args))
+				if len(selects) == 0 {
+					params[i] += " AS " + columns[i]
+				}
+			}
+			selects = append(selects, "SELECT "+strings.Join(params, ", "))
+		}
+
+		query := fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM (%s) AS v WHERE NOT EXISTS (SELECT 1 FROM %[1]s AS t WHERE %[5]s)",
+			table, strings.Join(columns, ", "), qualify("v", columns), strings.Join(selects, " UNION ALL "), strings.Join(match, " AND "))
+
+		var result sql.Result
+		if result, err = tx.ExecContext(ctx, query, args...); err != nil {
+			return 0, fmt.Errorf("could not insert into %s: %s", table, err)
+		}
+
+		var affected int64
+		if affected, err = result.RowsAffected(); err != nil {
+			return 0, fmt.Errorf("could not insert into %s: %s", table, err)
+		}
+		inserted += int(affected)
+	}
+	return inserted, nil
+}
+
+// Look up the ids of the nodes with the specified keys.
+func nodeIDs(ctx context.Context, tx *sql.Tx, tables GraphTables, keys []string) (ids []string, err error) {
+	var rows *sql.Rows
+	if rows, err = tx.QueryContext(ctx, fmt.Sprintf("SELECT %s, %s FROM %s", tables.Key, tables.ID, tables.Nodes)); err != nil {
+		return nil, fmt.Errorf("could not look up node ids: %s", err)
+	}
+	defer rows.Close()
+
+	lookup := make(map[string]string, len(keys))
+	for rows.Next() {
+		var key, id sql.NullString
+		if err = rows.Scan(&key, &id); err != nil {
+			return nil, fmt.Errorf("could not look up node ids: %s", err)
+		}
+		lookup[key.String] = id.String
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("could not look up node ids: %s", err)
+	}
+
+	ids = make([]string, len(keys))
+	for i, key := range keys {
+		var ok bool
+		if ids[i], ok = lookup[key]; !ok {
+			return nil, fmt.Errorf("could not look up the id of node %s", key)
+		}
+	}
+	return ids, nil
+}
@@ -0,0 +1,682 @@
+package seed
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/bbengfort/catena/migrations"
+	"github.com/lib/pq"
+)
+
+// The number of rows read from an import file between progress reports.
+const progress = 100000
+
+// ImportGraph upserts the nodes and edges of the graph files into the tables of the
+// mapping in a single transaction; either path may be empty to import only nodes or
+// only edges. Files are read as CSV, TSV or JSON lines by their extension (.csv, .tsv,
+// .jsonl) and their columns name the columns of the tables, empty CSV fields and JSON
+// nulls are imported as NULL. The nodes file must have the key column of the mapping
+// and the edges file its source and target columns, which contain the keys of nodes;
+// edges reference the id of their nodes if the mapping has an id column. The Columns
+// and Prefix of the mapping are not used.
+//
+// Nodes are upserted by their key and edges by their source and target, so importing
+// the same files again leaves the database unchanged; if a file has the same node or
+// edge more than once, its last row wins. On Postgres the rows are copied into
+// temporary staging tables with COPY and then merged into the tables with a few
+// set-based statements, so very large graphs can be imported; the edges table
+// should have an index on its source and target. Other dialects upsert row by row.
+//
+// Rows with the wrong number of fields, without a key, source or target, or with edges
+// between unknown nodes are not imported but written to rejects as CSV records of the
+// file, the row number (the line of JSON lines files), the reason and the fields of the
+// row. Any database error, such as a value that cannot be converted to the type of its
+// column, fails the import. Returns the number of nodes and edges that were inserted
+// and the number of rows that were rejected.
+func ImportGraph(conn *sql.DB, d migrations.Dialect, tables GraphTables, nodesPath, edgesPath string, rejects io.Writer) (nodes, edges, rejected int, err error) {
+	if err = tables.Validate(); err != nil {
+		return 0, 0, 0, err
+	}
+
+	imp := &importer{
+		ctx:     context.Background(),
+		d:       d,
+		tables:  tables,
+		rejects: csv.NewWriter(rejects),
+	}
+
+	if imp.tx, err = conn.BeginTx(imp.ctx, nil); err != nil {
+		return 0, 0, 0, fmt.Errorf("could not begin transaction: %s", err)
+	}
+	defer imp.tx.Rollback()
+
+	if nodesPath != "" {
+		if nodes, err = imp.nodes(nodesPath); err != nil {
+			return 0, 0, 0, err
+		}
+	}
+
+	if edgesPath != "" {
+		if edges, err = imp.edges(edgesPath); err != nil {
+			return 0, 0, 0, err
+		}
+	}
+
+	imp.rejects.Flush()
+	if err = imp.rejects.Error(); err != nil {
+		return 0, 0, 0, fmt.Errorf("could not write rejected rows: %s", err)
+	}
+
+	if err = imp.tx.Commit(); err != nil {
+		return 0, 0, 0, fmt.Errorf("could not commit graph import: %s", err)
+	}
+
+	logger.Info("imported %d nodes and %d edges into %s and %s (%d rows rejected)", nodes, edges, tables.Nodes, tables.Edges, imp.rejected)
+	return nodes, edges, imp.rejected, nil
+}
+
+// Imports the files of a graph inside of the import transaction.
+type importer struct {
+	ctx      context.Context
+	tx       *sql.Tx
+	d        migrations.Dialect
+	tables   GraphTables
+	rejects  *csv.Writer
+	rejected int
+}
+
+// A sink loads the valid rows of an import file into the database and returns the
+// number of rows that were inserted when it is finished.
+type sink struct {
+	write  func(r row) error
+	finish func() (inserted int, err error)
+}
+
+// Import the nodes file, copying it into a staging table on Postgres.
+func (imp *importer) nodes(path string) (inserted int, err error) {
+	var f *table
+	if f, err = openTable(path); err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	key := f.index(imp.tables.Key)
+	if key < 0 {
+		return 0, fmt.Errorf("%s does not have a %s column", path, imp.tables.Key)
+	}
+
+	var s sink
+	if imp.d == migrations.Postgres {
+		if s, err = imp.copyNodes(f.columns, true); err != nil {
+			return 0, err
+		}
+	} else {
+		s = imp.upsertNodes(f.columns, key)
+	}
+
+	err = imp.each(f, func(r row) error {
+		if r.values[key] == nil {
+			return imp.reject(path, r, "missing "+imp.tables.Key)
+		}
+		return s.write(r)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return s.finish()
+}
+
+// Import the edges file, copying it into a staging table on Postgres.
+func (imp *importer) edges(path string) (inserted int, err error) {
+	var f *table
+	if f, err = openTable(path); err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	source, target := f.index(imp.tables.Source), f.index(imp.tables.Target)
+	if source < 0 || target < 0 {
+		return 0, fmt.Errorf("%s does not have %s and %s columns", path, imp.tables.Source, imp.tables.Target)
+	}
+
+	var s sink
+	if imp.d == migrations.Postgres {
+		if s, err = imp.copyEdges(path, f.columns); err != nil {
+			return 0, err
+		}
+	} else {
+		s = imp.upsertEdges(path, f.columns, source, target)
+	}
+
+	err = imp.each(f, func(r row) error {
+		if r.values[source] == nil || r.values[target] == nil {
+			return imp.reject(path, r, fmt.Sprintf("missing %s or %s", imp.tables.Source, imp.tables.Target))
+		}
+		return s.write(r)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return s.finish()
+}
+
+// Read the rows of the file, rejecting the rows that cannot be parsed and reporting
+// progress as the rows are read.
+func (imp *importer) each(f *table, fn func(r row) error) (err error) {
+	for n := 1; ; n++ {
+		var (
+			r      row
+			reason string
+		)
+
+		if r, reason, err = f.next(); err != nil {
+			if err == io.EOF {
+				logger.Status("read %d rows of %s", n-1, f.path)
+				return nil
+			}
+			return err
+		}
+
+		if reason != "" {
+			err = imp.reject(f.path, r, reason)
+		} else {
+			err = fn(r)
+		}
+		if err != nil {
+			return err
+		}
+
+		if n%progress == 0 {
+			logger.Status("read %d rows of %s", n, f.path)
+		}
+	}
+}
+
+// Write the row to the rejects file with the reason that it was not imported.
+func (imp *importer) reject(path string, r row, reason string) error {
+	imp.rejected++
+	if err := imp.rejects.Write(append([]string{path, strconv.Itoa(r.n), reason}, r.raw...)); err != nil {
+		return fmt.Errorf("could not write rejected rows: %s", err)
+	}
+	return nil
+}
+
+// Upsert each node by its key.
+func (imp *importer) upsertNodes(columns []string, key int) sink {
+	var inserted int
+	natural := []string{imp.tables.Key}
+	return sink{
+		write: func(r row) (err error) {
+			var ok bool
+			if ok, err = upsert(imp.ctx, imp.tx, imp.d, imp.tables.Nodes, natural, r.fields(columns)); err != nil {
+				return fmt.Errorf("could not upsert node %s: %s", r.values[key], err)
+			}
+			if ok {
+				inserted++
+			}
+			return nil
+		},
+		finish: func() (int, error) { return inserted, nil },
+	}
+}
+
+// Upsert each edge by its source and target, looking up the nodes that it references
+// by their keys and rejecting edges between unknown nodes.
+func (imp *importer) upsertEdges(path string, columns []string, source, target int) sink {
+	var inserted int
+	ref := imp.tables.ID
+	if ref == "" {
+		ref = imp.tables.Key
+	}
+
+	// keys map to their reference, or to nil if there is no node with the key
+	refs := make(map[string]interface{})
+	lookup := func(key string) (interface{}, error) {
+		if id, ok := refs[key]; ok {
+			return id, nil
+		}
+
+		var id interface{}
+		query := fmt.Sprintf("SELECT %s FROM %s WHERE %s", ref, imp.tables.Nodes, conditions(imp.d, []string{imp.tables.Key}, 0))
+		if err := imp.tx.QueryRowContext(imp.ctx, query, key).Scan(&id); err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("could not look up node %s: %s", key, err)
+		}
+		refs[key] = id
+		return id, nil
+	}
+
+	edge := []string{imp.tables.Source, imp.tables.Target}
+	return sink{
+		write: func(r row) (err error) {
+			fields := r.fields(columns)
+			for _, i := range []int{source, target} {
+				if fields[columns[i]], err = lookup(r.values[i].(string)); err != nil {
+					return err
+				}
+				if fields[columns[i]] == nil {
+					return imp.reject(path, r, "unknown source or target node")
+				}
+			}
+
+			var ok bool
+			if ok, err = upsert(imp.ctx, imp.tx, imp.d, imp.tables.Edges, edge, fields); err != nil {
+				return fmt.Errorf("could not upsert edge from %s to %s: %s", r.values[source], r.values[target], err)
+			}
+			if ok {
+				inserted++
+			}
+			return nil
+		},
+		finish: func() (int, error) { return inserted, nil },
+	}
+}
+
+// Copy the nodes into a staging table with the columns of the file, then update the
+// existing nodes if update is true and insert the new ones from the last staged row of
+// each key.
+func (imp *importer) copyNodes(columns []string, update bool) (s sink, err error) {
+	const stage = "catena_import_nodes"
+	query := fmt.Sprintf("CREATE TEMPORARY TABLE %s ON COMMIT DROP AS SELECT 0::bigint AS catena_row, %s FROM %s WITH NO DATA", stage, strings.Join(columns, ", "), imp.tables.Nodes)
+	if _, err = imp.tx.ExecContext(imp.ctx, query); err != nil {
+		return s, fmt.Errorf("could not create staging table for %s: %s", imp.tables.Nodes, err)
+	}
+
+	key := imp.tables.Key
+	latest := fmt.Sprintf("(SELECT DISTINCT ON (%[1]s) * FROM %[2]s ORDER BY %[1]s, catena_row DESC) AS s", key, stage)
+	return imp.copyIn(stage, columns, func() (inserted int, err error) {
+		if sets := assignments(columns, key); update && sets != "" {
+			query := fmt.Sprintf("UPDATE %s AS t SET %s FROM %s WHERE t.%s = s.%[4]s", imp.tables.Nodes, sets, latest, key)
+			if _, err = imp.tx.ExecContext(imp.ctx, query); err != nil {
+				return 0, fmt.Errorf("could not update %s: %s", imp.tables.Nodes, err)
+			}
+		}
+
+		query := fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s WHERE NOT EXISTS (SELECT 1 FROM %[1]s AS t WHERE t.%[5]s = s.%[5]s)", imp.tables.Nodes, strings.Join(columns, ", "), qualify("s", columns), latest, key)
+		return imp.exec(query, "could not insert into %s: %s", imp.tables.Nodes)
+	})
+}
+
+// Copy the edges into a staging table in which the source and target are node keys,
+// reject the edges between unknown nodes, then update the existing edges and insert the
+// new ones from the last staged row of each source and target.
+func (imp *importer) copyEdges(path string, columns []string) (s sink, err error) {
+	const stage = "catena_import_edges"
+	tables := imp.tables
+	ref := tables.ID
+	if ref == "" {
+		ref = tables.Key
+	}
+
+	// the source and target are staged with the type of the node key, other columns
+	// with the type of their column of the edges table
+	staged := make([]string, len(columns))
+	for i, column := range columns {
+		switch column {
+		case tables.Source, tables.Target:
+			staged[i] = fmt.Sprintf("n.%s AS %s", tables.Key, column)
+		default:
+			staged[i] = "e." + column
+		}
+	}
+
+	query := fmt.Sprintf("CREATE TEMPORARY TABLE %s ON COMMIT DROP AS SELECT 0::bigint AS catena_row, %s FROM %s AS n, %s AS e WITH NO DATA", stage, strings.Join(staged, ", "), tables.Nodes, tables.Edges)
+	if _, err = imp.tx.ExecContext(imp.ctx, query); err != nil {
+		return s, fmt.Errorf("could not create staging table for %s: %s", tables.Edges, err)
+	}
+
+	resolved := make([]string, len(columns))
+	for i, column := range columns {
+		switch column {
+		case tables.Source:
+			resolved[i] = fmt.Sprintf("src.%s AS %s", ref, column)
+		case tables.Target:
+			resolved[i] = fmt.Sprintf("tgt.%s AS %s", ref, column)
+		default:
+			resolved[i] = "e." + column
+		}
+	}
+
+	latest := fmt.Sprintf("(SELECT DISTINCT ON (src.%[1]s, tgt.%[1]s) %[2]s FROM %[3]s AS e JOIN %[4]s AS src ON src.%[5]s = e.%[6]s JOIN %[4]s AS tgt ON tgt.%[5]s = e.%[7]s ORDER BY src.%[1]s, tgt.%[1]s, e.catena_row DESC) AS s",
+		ref, strings.Join(resolved, ", "), stage, tables.Nodes, tables.Key, tables.Source, tables.Target)
+	match := fmt.Sprintf("t.%[1]s = s.%[1]s AND t.%[2]s = s.%[2]s", tables.Source, tables.Target)
+
+	return imp.copyIn(stage, columns, func() (inserted int, err error) {
+		if err = imp.rejectUnknown(path, stage); err != nil {
+			return 0, err
+		}
+
+		if sets := assignments(columns, tables.Source, tables.Target); sets != "" {
+			query := fmt.Sprintf("UPDATE %s AS t SET %s FROM %s WHERE %s", tables.Edges, sets, latest, match)
+			if _, err = imp.tx.ExecContext(imp.ctx, query); err != nil {
+				return 0, fmt.Errorf("could not update %s: %s", tables.Edges, err)
+			}
+		}
+
+		query := fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s WHERE NOT EXISTS (SELECT 1 FROM %[1]s AS t WHERE %[5]s)", tables.Edges, strings.Join(columns, ", "), qualify("s", columns), latest, match)
+		return imp.exec(query, "could not insert into %s: %s", tables.Edges)
+	})
+}
+
+// Write the staged edges whose source or target is not a node to the rejects file.
+func (imp *importer) rejectUnknown(path, stage string) (err error) {
+	tables := imp.tables
+	query := fmt.Sprintf("SELECT catena_row, %[1]s, %[2]s FROM %[3]s AS e WHERE NOT EXISTS (SELECT 1 FROM %[4]s AS n WHERE n.%[5]s = e.%[1]s) OR NOT EXISTS (SELECT 1 FROM %[4]s AS n WHERE n.%[5]s = e.%[2]s) ORDER BY catena_row",
+		tables.Source, tables.Target, stage, tables.Nodes, tables.Key)
+
+	var rows *sql.Rows
+	if rows, err = imp.tx.QueryContext(imp.ctx, query); err != nil {
+		return fmt.Errorf("could not find edges between unknown nodes: %s", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			r              row
+			source, target string
+		)
+		if err = rows.Scan(&r.n, &source, &target); err != nil {
+			return fmt.Errorf("could not find edges between unknown nodes: %s", err)
+		}
+
+		r.raw = []string{source, target}
+		if err = imp.reject(path, r, "unknown source or target node"); err != nil {
+			return err
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("could not find edges between unknown nodes: %s", err)
+	}
+	return nil
+}
+
+// Returns a sink that copies the rows into the staging table, numbered by their row in
+// the file, and merges them into the table with the merge function once copied.
+func (imp *importer) copyIn(stage string, columns []string, merge func() (int, error)) (s sink, err error) {
+	var stmt *sql.Stmt
+	if stmt, err = imp.tx.PrepareContext(imp.ctx, pq.CopyIn(stage, append([]string{"catena_row"}, columns...)...)); err != nil {
+		return s, fmt.Errorf("could not copy into %s: %s", stage, err)
+	}
+
+	return sink{
+		write: func(r row) (err error) {
+			if _, err = stmt.ExecContext(imp.ctx, append([]interface{}{r.n}, r.values...)...); err != nil {
+				stmt.Close()
+				return fmt.Errorf("could not copy row %d into %s: %s", r.n, stage, err)
+			}
+			return nil
+		},
+		finish: func() (int, error) {
+			if _, err := stmt.ExecContext(imp.ctx); err != nil {
+				stmt.Close()
+				return 0, fmt.Errorf("could not copy into %s: %s", stage, err)
+			}
+			if err := stmt.Close(); err != nil {
+				return 0, fmt.Errorf("could not copy into %s: %s", stage, err)
+			}
+			return merge()
+		},
+	}, nil
+}
+
+// Execute the statement and return the number of rows that it affected.
+func (imp *importer) exec(query, format, table string) (n int, err error) {
+	var result sql.Result
+	if result, err = imp.tx.ExecContext(imp.ctx, query); err != nil {
+		return 0, fmt.Errorf(format, table, err)
+	}
+
+	var affected int64
+	if affected, err = result.RowsAffected(); err != nil {
+		return 0, fmt.Errorf(format, table, err)
+	}
+	return int(affected), nil
+}
+
+// Returns the assignments of the columns from the staged row s except the key columns.
+func assignments(columns []string, key ...string) string {
+	var sets []string
+	for _, column := range columns {
+		if !contains(key, column) {
+			sets = append(sets, fmt.Sprintf("%s = s.%[1]s", column))
+		}
+	}
+	return strings.Join(sets, ", ")
+}
+
+// Returns the columns qualified by the alias.
+func qualify(alias string, columns []string) string {
+	qualified := make([]string, len(columns))
+	for i, column := range columns {
+		qualified[i] = alias + "." + column
+	}
+	return strings.Join(qualified, ", ")
+}
+
+func contains(s []string, v string) bool {
+	for _, e := range s {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
+
+// A row of an import file: its values are strings or nil for NULL, and its raw fields
+// are written to the rejects file if the row is rejected.
+type row struct {
+	n      int
+	values []interface{}
+	raw    []string
+}
+
+// Returns the values of the row by their columns.
+func (r row) fields(columns []string) map[string]interface{} {
+	fields := make(map[string]interface{}, len(columns))
+	for i, column := range columns {
+		fields[column] = r.values[i]
+	}
+	return fields
+}
+
+// A table is an import file of rows whose columns are named by the header of CSV and
+// TSV files or by the keys of the first object of JSON lines files.
+type table struct {
+	path    string
+	columns []string
+	file    *os.File
+	csv     *csv.Reader
+	lines   *bufio.Scanner
+	first   *row
+	reason  string
+	n       int
+}
+
+// Open the import file and read its columns.
+func openTable(path string) (t *table, err error) {
+	t = &table{path: path}
+	if t.file, err = os.Open(path); err != nil {
+		return nil, fmt.Errorf("could not open %s: %s", path, err)
+	}
+
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".csv", ".tsv":
+		t.csv = csv.NewReader(bufio.NewReader(t.file))
+		t.csv.FieldsPerRecord = -1
+		if ext == ".tsv" {
+			t.csv.Comma = '\t'
+			t.csv.LazyQuotes = true
+		}
+
+		if t.columns, err = t.csv.Read(); err != nil {
+			t.Close()
+			return nil, fmt.Errorf("could not read the header of %s: %s", path, err)
+		}
+	case ".jsonl", ".ndjson":
+		t.lines = bufio.NewScanner(t.file)
+		t.lines.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+		// the columns are read from the first row, which is returned by the first call
+		// to next if it is valid
+		var (
+			first  row
+			reason string
+			object map[string]interface{}
+		)
+		if first, reason, object, err = t.object(); err != nil {
+			t.Close()
+			if err == io.EOF {
+				return nil, fmt.Errorf("%s does not have any rows", path)
+			}
+			return nil, err
+		}
+
+		if reason != "" {
+			t.Close()
+			return nil, fmt.Errorf("could not read the columns of %s from its first row: %s", path, reason)
+		}
+
+		for column := range object {
+			t.columns = append(t.columns, column)
+		}
+		sort.Strings(t.columns)
+		first.values, t.reason = t.values(object)
+		t.first = &first
+	default:
+		t.Close()
+		return nil, fmt.Errorf("cannot import %s, use a .csv, .tsv or .jsonl file", path)
+	}
+
+	seen := make(map[string]bool, len(t.columns))
+	for _, column := range t.columns {
+		if !identifier.MatchString(column) || strings.Contains(column, ".") {
+			t.Close()
+			return nil, fmt.Errorf("%q of %s is not a valid column name", column, path)
+		}
+		if seen[column] {
+			t.Close()
+			return nil, fmt.Errorf("%s has more than one %s column", path, column)
+		}
+		seen[column] = true
+	}
+	return t, nil
+}
+
+// Returns the index of the column, or -1 if the file does not have the column.
+func (t *table) index(column string) int {
+	for i, c := range t.columns {
+		if c == column {
+			return i
+		}
+	}
+	return -1
+}
+
+// Read the next row of the file, or the reason that it is rejected. Returns io.EOF at
+// the end of the file.
+func (t *table) next() (r row, reason string, err error) {
+	if t.csv != nil {
+		var record []string
+		t.n++
+		r.n = t.n
+		if record, err = t.csv.Read(); err != nil {
+			var perr *csv.ParseError
+			if errors.As(err, &perr) {
+				return r, perr.Err.Error(), nil
+			}
+			if err == io.EOF {
+				return r, "", err
+			}
+			return r, "", fmt.Errorf("could not read %s: %s", t.path, err)
+		}
+
+		r.raw = record
+		if len(record) != len(t.columns) {
+			return r, fmt.Sprintf("expected %d fields but found %d", len(t.columns), len(record)), nil
+		}
+
+		r.values = make([]interface{}, len(record))
+		for i, field := range record {
+			if field != "" {
+				r.values[i] = field
+			}
+		}
+		return r, "", nil
+	}
+
+	if t.first != nil {
+		r, t.first = *t.first, nil
+		return r, t.reason, nil
+	}
+
+	var object map[string]interface{}
+	if r, reason, object, err = t.object(); err != nil || reason != "" {
+		return r, reason, err
+	}
+	r.values, reason = t.values(object)
+	return r, reason, nil
+}
+
+// Read the next non-empty line of a JSON lines file as an object.
+func (t *table) object() (r row, reason string, object map[string]interface{}, err error) {
+	for t.lines.Scan() {
+		t.n++
+		line := strings.TrimSpace(t.lines.Text())
+		if line == "" {
+			continue
+		}
+
+		r = row{n: t.n, raw: []string{line}}
+		dec := json.NewDecoder(strings.NewReader(line))
+		dec.UseNumber()
+		if err = dec.Decode(&object); err != nil || object == nil {
+			return r, "not a json object", nil, nil
+		}
+		return r, "", object, nil
+	}
+
+	if err = t.lines.Err(); err != nil {
+		return r, "", nil, fmt.Errorf("could not read %s: %s", t.path, err)
+	}
+	return r, "", nil, io.EOF
+}
+
+// Returns the values of the columns from the object.
+func (t *table) values(object map[string]interface{}) (values []interface{}, reason string) {
+	values = make([]interface{}, len(t.columns))
+	for key, value := range object {
+		i := t.index(key)
+		if i < 0 {
+			return nil, fmt.Sprintf("unexpected column %s", key)
+		}
+
+		switch v := value.(type) {
+		case nil:
+		case string:
+			values[i] = v
+		case json.Number:
+			values[i] = v.String()
+		case bool:
+			values[i] = strconv.FormatBool(v)
+		default:
+			return nil, fmt.Sprintf("%s is not a string, number or boolean", key)
+		}
+	}
+	return values, ""
+}
+
+// Close the file.
+func (t *table) Close() error {
+	return t.file.Close()
+}
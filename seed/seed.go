@@ -0,0 +1,148 @@
+/*
+Package seed loads seed data into development, test and demo databases. Seed sets are
+directories of SQL files and YAML or JSON fixtures: files at the top of the directory
+are loaded into every environment, then the files in the subdirectory named for the
+environment, e.g. seeds/dev, each in lexical order. Fixtures are upserted by their
+natural keys and SQL files should be written to be re-runnable, so loading a seed set
+more than once leaves the database unchanged. The package can also generate synthetic
+social graphs to load test traversals against and import existing graphs in bulk from
+node and edge files.
+*/
+package seed
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/bbengfort/catena/logs"
+	"github.com/bbengfort/catena/migrations"
+)
+
+// Environments that seed data can be loaded into; seeding any other environment, such
+// as production, is refused.
+var Environments = []string{"dev", "test", "demo"}
+
+// logger reports the files and graphs that are loaded and the progress of imports.
+var logger = logs.New("seed")
+
+// SetLogger replaces the logger used by the seed package.
+func SetLogger(l *logs.Logger) {
+	logger = l
+}
+
+// CheckEnvironment returns an error if seed data cannot be loaded into the environment.
+func CheckEnvironment(env string) error {
+	for _, allowed := range Environments {
+		if env == allowed {
+			return nil
+		}
+	}
+	return fmt.Errorf("cannot seed the %q environment, seed data can only be loaded into %s", env, strings.Join(Environments, ", "))
+}
+
+// Load the seed set for the environment from dir in a single transaction, using the
+// dialect to bind the parameters of fixture upserts. Returns the number of files that
+// were loaded.
+func Load(conn *sql.DB, d migrations.Dialect, dir, env string) (n int, err error) {
+	if err = CheckEnvironment(env); err != nil {
+		return 0, err
+	}
+
+	var paths []string
+	if paths, err = files(dir, env); err != nil {
+		return 0, err
+	}
+
+	if len(paths) == 0 {
+		return 0, fmt.Errorf("no seed files found in %s for the %s environment", dir, env)
+	}
+
+	ctx := context.Background()
+	var tx *sql.Tx
+	if tx, err = conn.BeginTx(ctx, nil); err != nil {
+		return 0, fmt.Errorf("could not begin transaction: %s", err)
+	}
+	defer tx.Rollback()
+
+	for _, path := range paths {
+		if err = loadFile(ctx, tx, d, path); err != nil {
+			return 0, err
+		}
+		logger.Info("loaded seed file %s", path)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, fmt.Errorf("could not commit seed data: %s", err)
+	}
+	return len(paths), nil
+}
+
+// The extensions of the files in a seed set.
+var extensions = map[string]bool{".sql": true, ".yml": true, ".yaml": true, ".json": true}
+
+// Returns the seed files shared by all environments followed by those of the
+// environment, each sorted by filename.
+func files(dir, env string) (paths []string, err error) {
+	for _, path := range []string{dir, filepath.Join(dir, env)} {
+		var entries []os.FileInfo
+		if entries, err = ioutil.ReadDir(path); err != nil {
+			if os.IsNotExist(err) && path != dir {
+				continue
+			}
+			return nil, fmt.Errorf("could not read seed directory: %s", err)
+		}
+
+		names := make([]string, 0, len(entries))
+		for _, entry := range entries {
+			if !entry.IsDir() && extensions[strings.ToLower(filepath.Ext(entry.Name()))] {
+				names = append(names, entry.Name())
+			}
+		}
+
+		sort.Strings(names)
+		for _, name := range names {
+			paths = append(paths, filepath.Join(path, name))
+		}
+	}
+	return paths, nil
+}
+
+// Load a single SQL or fixture file in the transaction.
+func loadFile(ctx context.Context, tx *sql.Tx, d migrations.Dialect, path string) (err error) {
+	var data []byte
+	if data, err = ioutil.ReadFile(path); err != nil {
+		return fmt.Errorf("could not read seed file: %s", err)
+	}
+
+	if strings.ToLower(filepath.Ext(path)) != ".sql" {
+		var fixtures []Fixture
+		if fixtures, err = ParseFixtures(data); err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+
+		for _, fixture := range fixtures {
+			if err = fixture.load(ctx, tx, d); err != nil {
+				return fmt.Errorf("%s: %s", path, err)
+			}
+		}
+		return nil
+	}
+
+	var stmts []string
+	if stmts, err = migrations.SplitStatements(string(data)); err != nil {
+		return fmt.Errorf("%s:%s", path, err)
+	}
+
+	for _, stmt := range stmts {
+		if _, err = tx.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("%s: could not execute statement: %s", path, err)
+		}
+	}
+	return nil
+}
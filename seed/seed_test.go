@@ -0,0 +1,310 @@
+package seed_test
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"io/ioutil"
+	"math/rand"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"testing"
+
+	"github.com/bbengfort/catena/migrations"
+	. "github.com/bbengfort/catena/seed"
+	"github.com/stretchr/testify/require"
+
+	// use sqlite for local tests and postgres if a test database is available
+	_ "github.com/lib/pq"
+	_ "modernc.org/sqlite"
+)
+
+const schema = `CREATE TABLE groups (id integer PRIMARY KEY, name text NOT NULL UNIQUE);
+CREATE TABLE users (id integer PRIMARY KEY, username text NOT NULL UNIQUE, name text, email text);
+CREATE TABLE follows (follower text NOT NULL, followee text NOT NULL, PRIMARY KEY (follower, followee));
+CREATE TABLE edges (source integer NOT NULL REFERENCES users (id), target integer NOT NULL REFERENCES users (id));`
+
+func open(t *testing.T) *sql.DB {
+	conn, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "catena.db"))
+	require.NoError(t, err, "could not open database")
+	t.Cleanup(func() { conn.Close() })
+
+	_, err = conn.Exec(schema)
+	require.NoError(t, err, "could not create schema")
+	return conn
+}
+
+func count(t *testing.T, conn *sql.DB, table string) (n int) {
+	require.NoError(t, conn.QueryRow("SELECT count(*) FROM "+table).Scan(&n))
+	return n
+}
+
+// Test that seed sets are loaded for their environment and can be loaded repeatedly.
+func TestLoad(t *testing.T) {
+	conn := open(t)
+
+	n, err := Load(conn, migrations.SQLite, "testdata", "dev")
+	require.NoError(t, err)
+	require.Equal(t, 3, n)
+
+	for i := 0; i < 2; i++ {
+		require.Equal(t, 2, count(t, conn, "groups"))
+		require.Equal(t, 2, count(t, conn, "users"))
+		require.Equal(t, 2, count(t, conn, "follows"))
+
+		// loading the seed set again must not duplicate any rows
+		_, err = Load(conn, migrations.SQLite, "testdata", "dev")
+		require.NoError(t, err)
+	}
+
+	// fixtures update rows that have been modified
+	_, err = conn.Exec("UPDATE users SET name = 'Robert' WHERE username = 'bob'")
+	require.NoError(t, err)
+	_, err = Load(conn, migrations.SQLite, "testdata", "dev")
+	require.NoError(t, err)
+
+	var name string
+	require.NoError(t, conn.QueryRow("SELECT name FROM users WHERE username = 'bob'").Scan(&name))
+	require.Equal(t, "Bob", name)
+
+	// only the files of the environment are loaded
+	_, err = Load(conn, migrations.SQLite, "testdata", "demo")
+	require.NoError(t, err)
+	require.Equal(t, 3, count(t, conn, "users"))
+	require.Equal(t, 2, count(t, conn, "follows"))
+
+	_, err = Load(conn, migrations.SQLite, "testdata", "production")
+	require.EqualError(t, err, `cannot seed the "production" environment, seed data can only be loaded into dev, test, demo`)
+}
+
+func TestParseFixtures(t *testing.T) {
+	fixtures, err := ParseFixtures([]byte(`{"table": "users", "key": ["username"], "rows": [{"username": "alice", "id": 1}]}`))
+	require.NoError(t, err)
+	require.Len(t, fixtures, 1)
+	require.Equal(t, 1, fixtures[0].Rows[0]["id"])
+
+	_, err = ParseFixtures([]byte("table: users\nrows:\n  - {username: alice}"))
+	require.EqualError(t, err, "fixture for users is missing its natural key")
+
+	_, err = ParseFixtures([]byte("table: users\nkey: [username]\nrows:\n  - {name: alice}"))
+	require.EqualError(t, err, `row 1 of users is missing natural key column "username"`)
+
+	_, err = ParseFixtures([]byte("table: users; DROP TABLE users\nkey: [username]"))
+	require.EqualError(t, err, `"users; DROP TABLE users" is not a valid table name`)
+
+	_, err = ParseFixtures([]byte("table: users\nkey: [username]\nrows:\n  - {username: alice, tags: [a, b]}"))
+	require.EqualError(t, err, `row 1 of users has a nested value for column "tags"`)
+}
+
+func TestGenerators(t *testing.T) {
+	edges := BarabasiAlbert(100, 3, rand.New(rand.NewSource(42)))
+	require.Len(t, edges, 3*97)
+	require.Equal(t, edges, BarabasiAlbert(100, 3, rand.New(rand.NewSource(42))), "graphs should be reproducible from their seed")
+
+	seen := make(map[Edge]bool)
+	for _, edge := range edges {
+		require.Greater(t, edge.Source, edge.Target, "nodes should only follow earlier nodes")
+		require.False(t, seen[edge], "edges should not be repeated")
+		seen[edge] = true
+	}
+
+	edges = ErdosRenyi(200, 0.05, rand.New(rand.NewSource(42)))
+	require.InDelta(t, 0.05*200*199, len(edges), 300)
+
+	seen = make(map[Edge]bool)
+	for _, edge := range edges {
+		require.NotEqual(t, edge.Source, edge.Target, "graphs should not have self loops")
+		require.True(t, edge.Source >= 0 && edge.Source < 200 && edge.Target >= 0 && edge.Target < 200)
+		require.False(t, seen[edge], "edges should not be repeated")
+		seen[edge] = true
+	}
+
+	require.Len(t, ErdosRenyi(10, 1, nil), 90)
+	require.Empty(t, ErdosRenyi(10, 0, nil))
+	require.Empty(t, BarabasiAlbert(3, 3, nil))
+}
+
+// Test that generated graphs are inserted in batches and that loading them again does
+// not change the database.
+func TestLoadGraph(t *testing.T) {
+	loadGraph(t, open(t), migrations.SQLite)
+}
+
+// Test that generated graphs are copied into staging tables and inserted on Postgres.
+func TestLoadGraphPostgres(t *testing.T) {
+	loadGraph(t, openPostgres(t), migrations.Postgres)
+}
+
+func loadGraph(t *testing.T, conn *sql.DB, d migrations.Dialect) {
+	// the edges are inserted in more than one batch
+	edges := BarabasiAlbert(300, 2, rand.New(rand.NewSource(7)))
+	require.Greater(t, len(edges), 400)
+
+	tables := GraphTables{
+		Nodes:   "users",
+		Key:     "username",
+		ID:      "id",
+		Columns: map[string]string{"email": "%s@example.com"},
+		Prefix:  "synthetic",
+		Edges:   "edges",
+		Source:  "source",
+		Target:  "target",
+	}
+
+	nodes, inserted, err := LoadGraph(conn, d, tables, 300, edges)
+	require.NoError(t, err)
+	require.Equal(t, 300, nodes)
+	require.Equal(t, len(edges), inserted)
+
+	// loading the same graph again does not insert anything
+	nodes, inserted, err = LoadGraph(conn, d, tables, 300, edges)
+	require.NoError(t, err)
+	require.Zero(t, nodes)
+	require.Zero(t, inserted)
+	require.Equal(t, 300, count(t, conn, "users"))
+	require.Equal(t, len(edges), count(t, conn, "edges"))
+
+	var email string
+	require.NoError(t, conn.QueryRow("SELECT email FROM users WHERE username = 'synthetic7'").Scan(&email))
+	require.Equal(t, "synthetic7@example.com", email)
+
+	// edges reference nodes by their key if there is no id column
+	tables.ID, tables.Edges, tables.Source, tables.Target = "", "follows", "follower", "followee"
+	_, inserted, err = LoadGraph(conn, d, tables, 300, edges)
+	require.NoError(t, err)
+	require.Equal(t, len(edges), inserted)
+
+	var n int
+	require.NoError(t, conn.QueryRow("SELECT count(*) FROM follows WHERE follower = 'synthetic3' AND followee IN ('synthetic1', 'synthetic2')").Scan(&n))
+	require.Equal(t, 2, n)
+}
+
+// Test that graph files are imported with their invalid rows rejected and that
+// importing them again does not change the database.
+func TestImportGraph(t *testing.T) {
+	importGraph(t, open(t), migrations.SQLite)
+}
+
+// Test that graph files are copied into staging tables and merged on Postgres.
+func TestImportGraphPostgres(t *testing.T) {
+	importGraph(t, openPostgres(t), migrations.Postgres)
+}
+
+// Open the test database with the graph tables created in their own schema.
+func openPostgres(t *testing.T) *sql.DB {
+	// postgres://localhost:5432/catena_test?sslmode=disable
+	dburl := os.Getenv("CATENA_TEST_DATABASE")
+	if dburl == "" {
+		t.Skip("no test database available, set $CATENA_TEST_DATABASE")
+	}
+
+	// the tables are created in their own schema, which every connection searches
+	u, err := url.Parse(dburl)
+	require.NoError(t, err)
+	query := u.Query()
+	query.Set("search_path", "catena_import_test")
+	u.RawQuery = query.Encode()
+
+	conn, err := sql.Open("postgres", u.String())
+	require.NoError(t, err, "could not connect to database")
+	t.Cleanup(func() { conn.Close() })
+
+	_, err = conn.Exec("DROP SCHEMA IF EXISTS catena_import_test CASCADE; CREATE SCHEMA catena_import_test")
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Exec("DROP SCHEMA catena_import_test CASCADE") })
+
+	_, err = conn.Exec(`CREATE TABLE users (id serial PRIMARY KEY, username text NOT NULL UNIQUE, name text, email text);
+CREATE TABLE follows (follower text NOT NULL, followee text NOT NULL, PRIMARY KEY (follower, followee));
+CREATE TABLE edges (source integer NOT NULL REFERENCES users (id), target integer NOT NULL REFERENCES users (id), PRIMARY KEY (source, target));`)
+	require.NoError(t, err, "could not create schema")
+
+	return conn
+}
+
+func importGraph(t *testing.T, conn *sql.DB, d migrations.Dialect) {
+	dir := t.TempDir()
+	write := func(name, data string) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, ioutil.WriteFile(path, []byte(data), 0644))
+		return path
+	}
+
+	nodesPath := write("users.csv", "username,name,email\nalice,Alice,alice@example.com\nbob,Bob,\n,Nobody,nobody@example.com\ncarol,Carol\nbob,Robert,bob@example.com\n")
+	edgesPath := write("edges.jsonl", `{"source": "alice", "target": "bob"}
+{"source": "bob", "target": "carol"}
+not json
+
+{"source": "bob", "target": "alice"}
+{"source": "alice", "target": "bob"}
+{"source": "alice", "target": {"username": "bob"}}
+`)
+
+	tables := GraphTables{Nodes: "users", Key: "username", ID: "id", Edges: "edges", Source: "source", Target: "target"}
+
+	for i := 0; i < 2; i++ {
+		var rejects bytes.Buffer
+		nodes, edges, rejected, err := ImportGraph(conn, d, tables, nodesPath, edgesPath, &rejects)
+		require.NoError(t, err)
+		require.Equal(t, 5, rejected)
+
+		if i == 0 {
+			require.Equal(t, 2, nodes)
+			require.Equal(t, 2, edges)
+		} else {
+			// importing the same files again does not insert anything
+			require.Zero(t, nodes)
+			require.Zero(t, edges)
+		}
+
+		// Postgres rejects edges between unknown nodes after the edges are copied
+		reader := csv.NewReader(&rejects)
+		reader.FieldsPerRecord = -1
+		records, err := reader.ReadAll()
+		require.NoError(t, err)
+		require.Len(t, records, 5)
+		sort.SliceStable(records, func(i, j int) bool {
+			if records[i][0] != records[j][0] {
+				return records[i][0] == nodesPath
+			}
+			ri, _ := strconv.Atoi(records[i][1])
+			rj, _ := strconv.Atoi(records[j][1])
+			return ri < rj
+		})
+
+		require.Equal(t, []string{nodesPath, "3", "missing username", "", "Nobody", "nobody@example.com"}, records[0])
+		require.Equal(t, []string{nodesPath, "4", "expected 3 fields but found 2", "carol", "Carol"}, records[1])
+		require.Equal(t, []string{edgesPath, "2", "unknown source or target node"}, records[2][:3])
+		require.Equal(t, []string{edgesPath, "3", "not a json object", "not json"}, records[3])
+		require.Equal(t, []string{edgesPath, "7", "target is not a string, number or boolean", `{"source": "alice", "target": {"username": "bob"}}`}, records[4])
+	}
+
+	require.Equal(t, 2, count(t, conn, "users"))
+	require.Equal(t, 2, count(t, conn, "edges"))
+
+	// the last row of a node wins and empty fields are imported as NULL
+	var email sql.NullString
+	require.NoError(t, conn.QueryRow("SELECT email FROM users WHERE username = 'bob'").Scan(&email))
+	require.Equal(t, "bob@example.com", email.String)
+	require.NoError(t, conn.QueryRow("SELECT email FROM users WHERE username = 'alice'").Scan(&email))
+	require.Equal(t, "alice@example.com", email.String)
+
+	var n int
+	require.NoError(t, conn.QueryRow("SELECT count(*) FROM edges JOIN users ON users.id = edges.source WHERE users.username = 'bob'").Scan(&n))
+	require.Equal(t, 1, n)
+
+	// edges reference nodes by their key if there is no id column
+	tables.ID, tables.Edges, tables.Source, tables.Target = "", "follows", "follower", "followee"
+	_, edges, rejected, err := ImportGraph(conn, d, tables, "", write("follows.tsv", "follower\tfollowee\nalice\tbob\nbob\tdave\n"), ioutil.Discard)
+	require.NoError(t, err)
+	require.Equal(t, 1, edges)
+	require.Equal(t, 1, rejected)
+
+	// files must have the columns of the mapping and a supported format
+	_, _, _, err = ImportGraph(conn, d, tables, write("users.json", "[]"), "", ioutil.Discard)
+	require.EqualError(t, err, "cannot import "+filepath.Join(dir, "users.json")+", use a .csv, .tsv or .jsonl file")
+	_, _, _, err = ImportGraph(conn, d, tables, write("names.csv", "name\nalice\n"), "", ioutil.Discard)
+	require.EqualError(t, err, filepath.Join(dir, "names.csv")+" does not have a username column")
+}
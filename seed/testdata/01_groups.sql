@@ -0,0 +1,3 @@
+-- groups are shared by every environment; SQL seeds must be safe to re-run
+INSERT INTO groups (name) SELECT 'admins' WHERE NOT EXISTS (SELECT 1 FROM groups WHERE name = 'admins');
+INSERT INTO groups (name) SELECT 'readers' WHERE NOT EXISTS (SELECT 1 FROM groups WHERE name = 'readers');